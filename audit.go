@@ -63,13 +63,22 @@ func (a *Auditor) Insert(r *RequestBundle, key, ip string, user User, from, to m
 	return reply.Err
 }
 
+// remoteAddr is empty for changes made by background jobs, which have no
+// request.
+func (r *RequestBundle) remoteAddr() string {
+	if r.Request == nil {
+		return ""
+	}
+	return r.Request.RemoteAddr
+}
+
 func (r *RequestBundle) Audit(key, field, fromstr, tostr string) {
 	if r.Auditor != nil {
 		from := map[string]interface{}{}
 		from[field] = fromstr
 		to := map[string]interface{}{}
 		to[field] = tostr
-		err := r.Auditor.Insert(r, key, r.Request.RemoteAddr, r.AuthUser, from, to)
+		err := r.Auditor.Insert(r, key, r.remoteAddr(), r.AuthUser, from, to)
 		if err != nil {
 			r.Log.Error(err.Error())
 		}
@@ -78,7 +87,7 @@ func (r *RequestBundle) Audit(key, field, fromstr, tostr string) {
 
 func (r *RequestBundle) AuditMap(key string, from, to map[string]interface{}) {
 	if r.Auditor != nil {
-		err := r.Auditor.Insert(r, key, r.Request.RemoteAddr, r.AuthUser, from, to)
+		err := r.Auditor.Insert(r, key, r.remoteAddr(), r.AuthUser, from, to)
 		if err != nil {
 			r.Log.Error(err.Error())
 		}
@@ -0,0 +1,76 @@
+package twocloud
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type BlobStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+var BlobNotFoundError = errors.New("Blob not found.")
+var InvalidBlobKeyError = errors.New("Invalid blob key.")
+
+type FileBlobStore struct {
+	root string
+}
+
+func NewFileBlobStore(root string) (*FileBlobStore, error) {
+	err := os.MkdirAll(root, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &FileBlobStore{
+		root: root,
+	}, nil
+}
+
+func (f *FileBlobStore) path(key string) (string, error) {
+	if key == "" || strings.Contains(key, "..") || strings.ContainsAny(key, `/\`) {
+		return "", InvalidBlobKeyError
+	}
+	return filepath.Join(f.root, key), nil
+}
+
+func (f *FileBlobStore) Put(key string, data []byte) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (f *FileBlobStore) Get(key string) ([]byte, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, BlobNotFoundError
+	}
+	return data, err
+}
+
+func (f *FileBlobStore) Delete(key string) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
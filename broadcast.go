@@ -0,0 +1,455 @@
+package twocloud
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/fzzbt/radix/redis"
+	"strconv"
+	"time"
+)
+
+const defaultBroadcastBatchSize = 500
+
+type Broadcast struct {
+	ID         uint64          `json:"id,omitempty"`
+	Filter     BroadcastFilter `json:"filter,omitempty"`
+	Status     string          `json:"status,omitempty"`
+	Started    time.Time       `json:"started,omitempty"`
+	Finished   time.Time       `json:"finished,omitempty"`
+	Recipients int64           `json:"recipients,omitempty"`
+	Delivered  int64           `json:"delivered,omitempty"`
+	Failed     int64           `json:"failed,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+var BroadcastNotFoundError = errors.New("Broadcast not found.")
+
+func (r *RequestBundle) BroadcastNotifications(notifications []Notification, filter *BroadcastFilter) (Broadcast, error) {
+	// start instrumentation
+	if filter == nil {
+		filter = &BroadcastFilter{
+			Targets: "users",
+		}
+	}
+	if !filter.IsValidIn(r.clientTypes()) {
+		return Broadcast{}, InvalidBroadcastFilter
+	}
+	for _, notification := range notifications {
+		if notification.Nature == "" {
+			return Broadcast{}, InvalidNotificationError
+		}
+		if notification.Body == "" && !r.templates().Has(notification.Nature) {
+			return Broadcast{}, InvalidNotificationError
+		}
+	}
+	id, err := r.GetID()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return Broadcast{}, err
+	}
+	broadcast := Broadcast{
+		ID:      id,
+		Filter:  *filter,
+		Status:  "running",
+		Started: time.Now(),
+	}
+	err = r.storeBroadcast(broadcast)
+	// add repo call to instrumentation
+	if err != nil {
+		r.Log.Error(err.Error())
+		return Broadcast{}, err
+	}
+	err = r.eachBroadcastBatch(*filter, func(users []uint64) error {
+		users, err := r.claimBroadcastRecipients(broadcast.ID, users)
+		if err != nil {
+			return err
+		}
+		delivered, failed := int64(0), int64(0)
+		for _, user := range users {
+			if filter.Targets == "users" {
+				_, err := r.SendNotificationsToUser(User{ID: user}, copyNotifications(notifications))
+				if err != nil {
+					failed++
+					continue
+				}
+				delivered++
+				continue
+			}
+			devices, err := r.GetDevicesByUser(User{ID: user})
+			if err != nil {
+				failed++
+				continue
+			}
+			for _, device := range activeDevices(devices) {
+				if !filter.matchesClientType(device.ClientType) {
+					continue
+				}
+				_, err := r.SendNotificationsToDevice(device, copyNotifications(notifications))
+				if err != nil {
+					failed++
+					continue
+				}
+				delivered++
+			}
+		}
+		broadcast.Recipients += delivered + failed
+		broadcast.Delivered += delivered
+		broadcast.Failed += failed
+		return r.updateBroadcastProgress(broadcast.ID, delivered, failed)
+	})
+	broadcast.Status = "complete"
+	if err != nil {
+		r.Log.Error(err.Error())
+		broadcast.Status = "failed"
+		broadcast.Error = err.Error()
+	}
+	broadcast.Finished = time.Now()
+	finishErr := r.finishBroadcast(broadcast)
+	if finishErr != nil {
+		r.Log.Error(finishErr.Error())
+	}
+	// stop instrumentation
+	return broadcast, err
+}
+
+// claimBroadcastRecipients returns the users who haven't been sent the
+// broadcast yet, and records that they have now.
+func (r *RequestBundle) claimBroadcastRecipients(id uint64, users []uint64) ([]uint64, error) {
+	key := "broadcasts:" + strconv.FormatUint(id, 10) + ":recipients"
+	reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		for _, user := range users {
+			mc.Sadd(key, user)
+		}
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return []uint64{}, reply.Err
+	}
+	claimed := []uint64{}
+	for pos, elem := range reply.Elems {
+		added, err := elem.Int64()
+		if err != nil {
+			r.Log.Error(err.Error())
+			continue
+		}
+		if added == 1 {
+			claimed = append(claimed, users[pos])
+		}
+	}
+	return claimed, nil
+}
+
+func copyNotifications(notifications []Notification) []Notification {
+	copied := make([]Notification, len(notifications))
+	copy(copied, notifications)
+	return copied
+}
+
+func (b *BroadcastFilter) matchesClientType(clientType string) bool {
+	if len(b.ClientType) < 1 {
+		return true
+	}
+	for _, t := range b.ClientType {
+		if t == clientType {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RequestBundle) subscriptionState(expires time.Time) string {
+	now := time.Now()
+	if expires.After(now) {
+		return "active"
+	}
+	if expires.Add(time.Hour * 24 * r.Config.GracePeriod).After(now) {
+		return "grace"
+	}
+	return "expired"
+}
+
+func (r *RequestBundle) eachBroadcastBatch(filter BroadcastFilter, fn func(users []uint64) error) error {
+	size := r.Config.BroadcastBatchSize
+	if size < 1 {
+		size = defaultBroadcastBatchSize
+	}
+	key := "users_by_join_date"
+	min, max := "-inf", "+inf"
+	checkSubscription := filter.Subscription != ""
+	if !filter.ActiveAfter.IsZero() || !filter.ActiveBefore.IsZero() {
+		key = "users_by_last_active"
+		if !filter.ActiveAfter.IsZero() {
+			min = strconv.FormatInt(filter.ActiveAfter.Unix(), 10)
+		}
+		if !filter.ActiveBefore.IsZero() {
+			max = strconv.FormatInt(filter.ActiveBefore.Unix(), 10)
+		}
+	} else if filter.Subscription != "" {
+		key = "users_by_subscription_expiration"
+		now := time.Now().Unix()
+		grace := time.Now().Add(-time.Hour * 24 * r.Config.GracePeriod).Unix()
+		switch filter.Subscription {
+		case "active":
+			min = "(" + strconv.FormatInt(now, 10)
+		case "grace":
+			min = "(" + strconv.FormatInt(grace, 10)
+			max = strconv.FormatInt(now, 10)
+		case "expired":
+			max = strconv.FormatInt(grace, 10)
+		}
+		checkSubscription = false
+	}
+	// pages start at the score the last one ended on rather than at an
+	// offset, so users whose score changes mid-broadcast don't shift the
+	// pages; skip counts the users already seen at that score. Scores only
+	// move forward, so a user may come round twice but is never missed.
+	skip := 0
+	for {
+		reply := r.Repo.client.Zrangebyscore(key, min, max, "WITHSCORES", "LIMIT", skip, size)
+		// add repo call to instrumentation
+		if reply.Err != nil {
+			r.Log.Error(reply.Err.Error())
+			return reply.Err
+		}
+		if reply.Type == redis.ReplyNil {
+			return nil
+		}
+		elems, err := reply.List()
+		if err != nil {
+			r.Log.Error(err.Error())
+			return err
+		}
+		if len(elems) < 2 {
+			return nil
+		}
+		ids := []string{}
+		last, tied := "", 0
+		for pos := 0; pos+1 < len(elems); pos += 2 {
+			ids = append(ids, elems[pos])
+			if elems[pos+1] != last {
+				last, tied = elems[pos+1], 0
+			}
+			tied++
+		}
+		full := len(ids) >= size
+		if last == min && tied == len(ids) {
+			skip += tied
+		} else {
+			skip = tied
+		}
+		min = last
+		if checkSubscription {
+			ids, err = r.filterBySubscription(ids, filter.Subscription)
+			if err != nil {
+				return err
+			}
+		}
+		users := []uint64{}
+		for _, idstr := range ids {
+			id, err := strconv.ParseUint(idstr, 10, 64)
+			if err != nil {
+				r.Log.Error(err.Error())
+				continue
+			}
+			users = append(users, id)
+		}
+		err = fn(users)
+		if err != nil {
+			return err
+		}
+		if !full {
+			return nil
+		}
+	}
+}
+
+func (r *RequestBundle) filterBySubscription(ids []string, state string) ([]string, error) {
+	reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		for _, id := range ids {
+			mc.Hget("users:"+id, "subscription_expires")
+		}
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return []string{}, reply.Err
+	}
+	matched := []string{}
+	for pos, elem := range reply.Elems {
+		if elem.Type == redis.ReplyNil {
+			continue
+		}
+		expiresstr, err := elem.Str()
+		if err != nil {
+			r.Log.Error(err.Error())
+			continue
+		}
+		expires, err := time.Parse(time.RFC3339, expiresstr)
+		if err != nil {
+			r.Log.Error(err.Error())
+			continue
+		}
+		if r.subscriptionState(expires) == state {
+			matched = append(matched, ids[pos])
+		}
+	}
+	return matched, nil
+}
+
+func (r *RequestBundle) storeBroadcast(broadcast Broadcast) error {
+	// start instrumentation
+	filter, err := json.Marshal(broadcast.Filter)
+	if err != nil {
+		return err
+	}
+	changes := map[string]interface{}{
+		"filter":     string(filter),
+		"status":     broadcast.Status,
+		"started":    broadcast.Started.Format(time.RFC3339),
+		"recipients": 0,
+		"delivered":  0,
+		"failed":     0,
+	}
+	from := map[string]interface{}{
+		"filter":     "",
+		"status":     "",
+		"started":    "",
+		"recipients": "",
+		"delivered":  "",
+		"failed":     "",
+	}
+	reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		mc.Hmset("broadcasts:"+strconv.FormatUint(broadcast.ID, 10), changes)
+		mc.Zadd("broadcasts", broadcast.Started.Unix(), broadcast.ID)
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return reply.Err
+	}
+	r.AuditMap("broadcasts:"+strconv.FormatUint(broadcast.ID, 10), from, changes)
+	// stop instrumentation
+	return nil
+}
+
+func (r *RequestBundle) updateBroadcastProgress(id uint64, delivered, failed int64) error {
+	key := "broadcasts:" + strconv.FormatUint(id, 10)
+	reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		mc.Hincrby(key, "recipients", delivered+failed)
+		mc.Hincrby(key, "delivered", delivered)
+		mc.Hincrby(key, "failed", failed)
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return reply.Err
+	}
+	return nil
+}
+
+func (r *RequestBundle) finishBroadcast(broadcast Broadcast) error {
+	// start instrumentation
+	changes := map[string]interface{}{
+		"status":   broadcast.Status,
+		"finished": broadcast.Finished.Format(time.RFC3339),
+		"error":    broadcast.Error,
+	}
+	from := map[string]interface{}{
+		"status":   "running",
+		"finished": "",
+		"error":    "",
+	}
+	key := "broadcasts:" + strconv.FormatUint(broadcast.ID, 10)
+	reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		mc.Hmset(key, changes)
+		mc.Del(key + ":recipients")
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return reply.Err
+	}
+	r.AuditMap(key, from, changes)
+	// stop instrumentation
+	return nil
+}
+
+func (r *RequestBundle) GetBroadcast(id uint64) (Broadcast, error) {
+	// start instrumentation
+	reply := r.Repo.client.Hgetall("broadcasts:" + strconv.FormatUint(id, 10))
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return Broadcast{}, reply.Err
+	}
+	if reply.Type == redis.ReplyNil {
+		return Broadcast{}, BroadcastNotFoundError
+	}
+	hash, err := reply.Hash()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return Broadcast{}, err
+	}
+	started, err := time.Parse(time.RFC3339, hash["started"])
+	if err != nil {
+		r.Log.Error(err.Error())
+		return Broadcast{}, err
+	}
+	broadcast := Broadcast{
+		ID:      id,
+		Status:  hash["status"],
+		Started: started,
+		Error:   hash["error"],
+	}
+	if hash["finished"] != "" {
+		broadcast.Finished, err = time.Parse(time.RFC3339, hash["finished"])
+		if err != nil {
+			r.Log.Error(err.Error())
+			return Broadcast{}, err
+		}
+	}
+	err = json.Unmarshal([]byte(hash["filter"]), &broadcast.Filter)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return Broadcast{}, err
+	}
+	broadcast.Recipients, _ = strconv.ParseInt(hash["recipients"], 10, 64)
+	broadcast.Delivered, _ = strconv.ParseInt(hash["delivered"], 10, 64)
+	broadcast.Failed, _ = strconv.ParseInt(hash["failed"], 10, 64)
+	// stop instrumentation
+	return broadcast, nil
+}
+
+func (r *RequestBundle) GetBroadcasts(count int) ([]Broadcast, error) {
+	// start instrumentation
+	reply := r.Repo.client.Zrevrange("broadcasts", 0, count-1)
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return []Broadcast{}, reply.Err
+	}
+	if reply.Type == redis.ReplyNil {
+		return []Broadcast{}, nil
+	}
+	ids, err := reply.List()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return []Broadcast{}, err
+	}
+	broadcasts := []Broadcast{}
+	for _, idstr := range ids {
+		id, err := strconv.ParseUint(idstr, 10, 64)
+		if err != nil {
+			r.Log.Error(err.Error())
+			continue
+		}
+		broadcast, err := r.GetBroadcast(id)
+		if err != nil {
+			continue
+		}
+		broadcasts = append(broadcasts, broadcast)
+	}
+	// stop instrumentation
+	return broadcasts, nil
+}
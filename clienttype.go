@@ -0,0 +1,236 @@
+package twocloud
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/fzzbt/radix/redis"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CapabilityOpenURL       = "open_url"
+	CapabilityReceiveFiles  = "receive_files"
+	CapabilityNotifications = "notifications"
+)
+
+type ClientType struct {
+	Name         string   `json:"name"`
+	DisplayName  string   `json:"display_name,omitempty"`
+	Platform     string   `json:"platform,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Deprecated   bool     `json:"deprecated,omitempty"`
+}
+
+func (c ClientType) Can(capability string) bool {
+	for _, have := range c.Capabilities {
+		if have == capability {
+			return true
+		}
+	}
+	return false
+}
+
+var InvalidClientTypeDefinitionError = errors.New("A client type must have a name made of a-z, 0-9 and _.")
+var DeprecatedClientTypeError = errors.New("That client type is deprecated and can't be used for new devices.")
+
+// clientTypesRefresh is how long a registry goes before it picks up the
+// client types stored by other processes.
+const clientTypesRefresh = time.Minute
+
+type ClientTypeRegistry struct {
+	types  map[string]ClientType
+	loaded time.Time
+	lock   sync.RWMutex
+}
+
+func NewClientTypeRegistry(types ...ClientType) *ClientTypeRegistry {
+	registry := &ClientTypeRegistry{
+		types: map[string]ClientType{},
+	}
+	for _, clientType := range types {
+		registry.Register(clientType)
+	}
+	return registry
+}
+
+func (c *ClientTypeRegistry) Register(clientType ClientType) error {
+	if !validClientTypeName(clientType.Name) {
+		return InvalidClientTypeDefinitionError
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.types[clientType.Name] = clientType
+	return nil
+}
+
+func (c *ClientTypeRegistry) Get(name string) (ClientType, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	clientType, exists := c.types[name]
+	return clientType, exists
+}
+
+func (c *ClientTypeRegistry) Types() []ClientType {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	names := []string{}
+	for name, _ := range c.types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	types := []ClientType{}
+	for _, name := range names {
+		types = append(types, c.types[name])
+	}
+	return types
+}
+
+func (c *ClientTypeRegistry) stale() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return time.Now().Sub(c.loaded) > clientTypesRefresh
+}
+
+func (c *ClientTypeRegistry) markLoaded() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.loaded = time.Now()
+}
+
+func validClientTypeName(name string) bool {
+	if name == "" {
+		return false
+	}
+	return strings.IndexFunc(name, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z') && !(r >= '0' && r <= '9') && r != '_'
+	}) < 0
+}
+
+// builtinClientTypes are the client types every registry starts with.
+var builtinClientTypes = []ClientType{
+	ClientType{Name: "android_phone", DisplayName: "Android Phone", Platform: "android", Capabilities: []string{CapabilityOpenURL, CapabilityReceiveFiles, CapabilityNotifications}},
+	ClientType{Name: "android_tablet", DisplayName: "Android Tablet", Platform: "android", Capabilities: []string{CapabilityOpenURL, CapabilityReceiveFiles, CapabilityNotifications}},
+	ClientType{Name: "chromebook", DisplayName: "Chromebook", Platform: "chrome_os", Capabilities: []string{CapabilityOpenURL, CapabilityNotifications}},
+	ClientType{Name: "macbook_chrome", DisplayName: "Chrome on Mac", Platform: "chrome", Capabilities: []string{CapabilityOpenURL, CapabilityNotifications}},
+	ClientType{Name: "windows_chrome", DisplayName: "Chrome on Windows", Platform: "chrome", Capabilities: []string{CapabilityOpenURL, CapabilityNotifications}},
+}
+
+// clientTypes returns the bundle's client type registry, reloading the
+// configured and stored types once they're out of date. Bundles made by
+// NewRequestBundle share one registry; any other bundle starts its own.
+func (r *RequestBundle) clientTypes() *ClientTypeRegistry {
+	if r.ClientTypes == nil || r.ClientTypes.stale() {
+		err := r.LoadClientTypes()
+		if err != nil {
+			r.Log.Error(err.Error())
+		}
+	}
+	return r.ClientTypes
+}
+
+// deviceCan reports whether a device's client type has a capability.
+func (r *RequestBundle) deviceCan(device Device, capability string) bool {
+	clientType, exists := r.clientTypes().Get(device.ClientType)
+	return exists && clientType.Can(capability)
+}
+
+// LoadClientTypes registers the client types from configuration, then the
+// ones admins have stored, which take precedence. Invalid types are logged
+// and skipped. The registry counts as loaded even if Redis can't be
+// reached, so it's tried again once per refresh rather than on every call.
+func (r *RequestBundle) LoadClientTypes() error {
+	// start instrumentation
+	if r.ClientTypes == nil {
+		r.ClientTypes = NewClientTypeRegistry(builtinClientTypes...)
+	}
+	defer r.ClientTypes.markLoaded()
+	for _, clientType := range r.Config.ClientTypes {
+		err := r.ClientTypes.Register(clientType)
+		if err != nil {
+			r.Log.Error(err.Error())
+		}
+	}
+	reply := r.Repo.client.Hgetall("client_types")
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return reply.Err
+	}
+	if reply.Type == redis.ReplyNil {
+		return nil
+	}
+	hash, err := reply.Hash()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return err
+	}
+	for _, encoded := range hash {
+		var clientType ClientType
+		err = json.Unmarshal([]byte(encoded), &clientType)
+		if err != nil {
+			r.Log.Error(err.Error())
+			continue
+		}
+		err = r.ClientTypes.Register(clientType)
+		if err != nil {
+			r.Log.Error(err.Error())
+		}
+	}
+	// stop instrumentation
+	return nil
+}
+
+// StoreClientType adds or replaces a client type. Other processes pick it
+// up the next time their registries reload.
+func (r *RequestBundle) StoreClientType(clientType ClientType) (ClientType, error) {
+	// start instrumentation
+	clientType.Name = strings.TrimSpace(clientType.Name)
+	clientType.DisplayName = strings.TrimSpace(clientType.DisplayName)
+	clientType.Platform = strings.TrimSpace(clientType.Platform)
+	if !validClientTypeName(clientType.Name) {
+		return ClientType{}, InvalidClientTypeDefinitionError
+	}
+	encoded, err := json.Marshal(clientType)
+	if err != nil {
+		return ClientType{}, err
+	}
+	from := ""
+	if old, exists := r.clientTypes().Get(clientType.Name); exists {
+		previous, err := json.Marshal(old)
+		if err != nil {
+			return ClientType{}, err
+		}
+		from = string(previous)
+	}
+	reply := r.Repo.client.Hset("client_types", clientType.Name, string(encoded))
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return ClientType{}, reply.Err
+	}
+	r.Audit("client_types", clientType.Name, from, string(encoded))
+	// add repo call to instrumentation
+	err = r.clientTypes().Register(clientType)
+	if err != nil {
+		return ClientType{}, err
+	}
+	// stop instrumentation
+	return clientType, nil
+}
+
+// DeprecateClientType stops new devices from being added with a client
+// type. Devices that already use it keep working.
+func (r *RequestBundle) DeprecateClientType(name string) (ClientType, error) {
+	clientType, exists := r.clientTypes().Get(name)
+	if !exists {
+		return ClientType{}, InvalidClientType
+	}
+	if clientType.Deprecated {
+		return clientType, nil
+	}
+	clientType.Deprecated = true
+	return r.StoreClientType(clientType)
+}
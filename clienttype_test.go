@@ -0,0 +1,55 @@
+package twocloud
+
+import (
+	"testing"
+)
+
+func TestLoadClientTypesSkipsInvalidConfiguredTypes(t *testing.T) {
+	r, _ := testBundle(t)
+	r.Config.ClientTypes = []ClientType{
+		{Name: "Smart Fridge"},
+		{Name: "kiosk", Capabilities: []string{CapabilityOpenURL}},
+	}
+	err := r.LoadClientTypes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := r.ClientTypes.Get("kiosk"); !exists {
+		t.Error("The valid configured type wasn't registered.")
+	}
+	if r.ClientTypes.stale() {
+		t.Error("The registry wasn't marked loaded.")
+	}
+}
+
+func TestClientTypesAreSharedAndNotReloadedPerRequest(t *testing.T) {
+	r, server := testBundle(t)
+	r.ClientTypes = NewClientTypeRegistry(builtinClientTypes...)
+	err := r.LoadClientTypes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a fresh registry would have to go to Redis, which is now failing
+	server.SetError("ERR injected failure")
+	defer server.SetError("")
+	request := *r
+	if request.clientTypes() != r.ClientTypes {
+		t.Error("The request's bundle didn't share the base registry.")
+	}
+	if !request.deviceCan(Device{ClientType: "android_phone"}, CapabilityReceiveFiles) {
+		t.Error("Expected android_phone to receive files.")
+	}
+}
+
+func TestClientTypesMarkedLoadedWhenRedisFails(t *testing.T) {
+	r, server := testBundle(t)
+	server.SetError("ERR injected failure")
+	defer server.SetError("")
+	err := r.LoadClientTypes()
+	if err == nil {
+		t.Fatal("Expected loading the stored types to fail.")
+	}
+	if r.ClientTypes.stale() {
+		t.Error("A failed load should still wait for the next refresh.")
+	}
+}
@@ -6,15 +6,43 @@ import (
 )
 
 type Config struct {
-	UseSubscriptions        bool              `json:"subscriptions"`
-	MaintenanceMode         bool              `json:"maintenance"`
-	Database                redis.Config      `json:"db"`
-	AuditDatabase           redis.Config      `json:"audit_db"`
-	InstrumentationDatabase redis.Config      `json:"instrumentation_db"`
-	OAuth                   OAuthClient       `json:"oauth"`
-	TrialPeriod             time.Duration     `json:"trial_period"`
-	GracePeriod             time.Duration     `json:"grace_period"`
-	Generator               IDGenerator       `json:"id_gen"`
+	UseSubscriptions        bool          `json:"subscriptions"`
+	MaintenanceMode         bool          `json:"maintenance"`
+	Database                redis.Config  `json:"db"`
+	AuditDatabase           redis.Config  `json:"audit_db"`
+	InstrumentationDatabase redis.Config  `json:"instrumentation_db"`
+	OAuth                   OAuthClient   `json:"oauth"`
+	TrialPeriod             time.Duration `json:"trial_period"`
+	GracePeriod             time.Duration `json:"grace_period"`
+	Generator               IDGenerator   `json:"id_gen"`
+	MaxFileSize             int64         `json:"max_file_size"`
+	DuplicateWindow         time.Duration `json:"duplicate_window"`
+	Screening               Screening     `json:"screening"`
+	BroadcastBatchSize      int           `json:"broadcast_batch_size"`
+	Templates               string        `json:"templates"`
+	DefaultLocale           string        `json:"default_locale"`
+	DigestSender            string        `json:"digest_sender"`
+	Maildir                 string        `json:"maildir"`
+	GCM                     GCMConfig     `json:"gcm"`
+	SSEHeartbeat            time.Duration `json:"sse_heartbeat"`
+	PresenceOnline          time.Duration `json:"presence_online"`
+	PresenceIdle            time.Duration `json:"presence_idle"`
+	DeviceDormancy          time.Duration `json:"device_dormancy"`
+	DeviceExpiry            time.Duration `json:"device_expiry"`
+	ClientTypes             []ClientType  `json:"client_types"`
+}
+
+type GCMConfig struct {
+	Endpoint       string        `json:"endpoint"`
+	APIKey         string        `json:"api_key"`
+	MaxRetries     int           `json:"max_retries"`
+	InitialBackoff time.Duration `json:"initial_backoff"`
+}
+
+type Screening struct {
+	Blocklist string                      `json:"blocklist"`
+	CacheTTL  time.Duration               `json:"cache_ttl"`
+	Actions   map[Verdict]ScreeningAction `json:"actions"`
 }
 
 type OAuthClient struct {
@@ -25,5 +53,5 @@ type OAuthClient struct {
 
 type IDGenerator struct {
 	Address string `json:"address"`
-	Token string `json:"token"`
+	Token   string `json:"token"`
 }
@@ -0,0 +1,278 @@
+package twocloud
+
+import (
+	"errors"
+	"github.com/fzzbt/radix/redis"
+	"strconv"
+	"time"
+)
+
+const (
+	PusherGCM        = "gcm"
+	PusherWebSockets = "websockets"
+	PusherSSE        = "sse"
+)
+
+// deliveries are support data rather than history, so they're kept for a
+// limited time and each device's list is capped.
+const deliveryRetention = time.Hour * 24 * 30
+const maxDeviceDeliveries = 500
+
+type DeliveryStatus string
+
+const (
+	DeliveryQueued    = DeliveryStatus("queued")
+	DeliverySent      = DeliveryStatus("sent")
+	DeliveryDelivered = DeliveryStatus("delivered")
+	DeliveryAcked     = DeliveryStatus("acked")
+	DeliveryFailed    = DeliveryStatus("failed")
+)
+
+var deliveryStatusOrder = map[DeliveryStatus]int{
+	DeliveryQueued:    0,
+	DeliverySent:      1,
+	DeliveryDelivered: 2,
+	DeliveryAcked:     3,
+}
+
+func (s DeliveryStatus) IsValid() bool {
+	_, ordered := deliveryStatusOrder[s]
+	return ordered || s == DeliveryFailed
+}
+
+type Delivery struct {
+	ID           uint64         `json:"id,omitempty"`
+	Notification uint64         `json:"notification,omitempty"`
+	Device       uint64         `json:"device,omitempty"`
+	Pusher       string         `json:"pusher,omitempty"`
+	Status       DeliveryStatus `json:"status,omitempty"`
+	Error        string         `json:"error,omitempty"`
+	Queued       time.Time      `json:"queued,omitempty"`
+	Updated      time.Time      `json:"updated,omitempty"`
+}
+
+var DeliveryNotFoundError = errors.New("Delivery not found.")
+var InvalidDeliveryStatusError = errors.New("Invalid delivery status.")
+var DeliveryStatusRegressionError = errors.New("A delivery's status can't move backwards or change once it has failed.")
+
+func (r *RequestBundle) queueDeliveries(notifications []Notification, devices []Device) ([]Delivery, error) {
+	// start instrumentation
+	deliveries := []Delivery{}
+	now := time.Now()
+	for _, notification := range notifications {
+		if !notification.ShouldPush() {
+			continue
+		}
+		for _, device := range devices {
+			if !r.deviceCan(device, CapabilityNotifications) {
+				continue
+			}
+			for _, pusher := range r.devicePushers(device) {
+				id, err := r.GetID()
+				if err != nil {
+					r.Log.Error(err.Error())
+					return []Delivery{}, err
+				}
+				deliveries = append(deliveries, Delivery{
+					ID:           id,
+					Notification: notification.ID,
+					Device:       device.ID,
+					Pusher:       pusher,
+					Status:       DeliveryQueued,
+					Queued:       now,
+					Updated:      now,
+				})
+			}
+		}
+	}
+	if len(deliveries) < 1 {
+		return deliveries, nil
+	}
+	reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		for _, delivery := range deliveries {
+			key := "deliveries:" + strconv.FormatUint(delivery.ID, 10)
+			mc.Hmset(key, map[string]interface{}{
+				"notification": delivery.Notification,
+				"device":       delivery.Device,
+				"pusher":       delivery.Pusher,
+				"status":       string(delivery.Status),
+				"error":        "",
+				"queued":       delivery.Queued.Format(time.RFC3339),
+				"updated":      delivery.Updated.Format(time.RFC3339),
+			})
+			mc.Expire(key, int64(deliveryRetention.Seconds()))
+			notificationKey := "notifications:" + strconv.FormatUint(delivery.Notification, 10) + ":deliveries"
+			mc.Lpush(notificationKey, delivery.ID)
+			mc.Expire(notificationKey, int64(deliveryRetention.Seconds()))
+			deviceKey := "devices:" + strconv.FormatUint(delivery.Device, 10) + ":deliveries"
+			mc.Lpush(deviceKey, delivery.ID)
+			mc.Ltrim(deviceKey, 0, maxDeviceDeliveries-1)
+		}
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return []Delivery{}, reply.Err
+	}
+	// stop instrumentation
+	return deliveries, nil
+}
+
+// UpdateDeliveryStatus records the progress of a delivery attempt. Statuses
+// only move forward, from queued through sent and delivered to acked, and
+// any unfinished delivery can fail. Once a pusher has sent a notification,
+// its last used time on the device is updated.
+func (r *RequestBundle) UpdateDeliveryStatus(delivery Delivery, status DeliveryStatus, detail string) (Delivery, error) {
+	// start instrumentation
+	if !status.IsValid() {
+		return Delivery{}, InvalidDeliveryStatusError
+	}
+	if delivery.Status == DeliveryFailed || delivery.Status == DeliveryAcked {
+		return Delivery{}, DeliveryStatusRegressionError
+	}
+	if status != DeliveryFailed && deliveryStatusOrder[status] < deliveryStatusOrder[delivery.Status] {
+		return Delivery{}, DeliveryStatusRegressionError
+	}
+	wasQueued := delivery.Status == DeliveryQueued
+	delivery.Status = status
+	delivery.Error = detail
+	delivery.Updated = time.Now()
+	reply := r.Repo.client.Hmset("deliveries:"+strconv.FormatUint(delivery.ID, 10), map[string]interface{}{
+		"status":  string(delivery.Status),
+		"error":   delivery.Error,
+		"updated": delivery.Updated.Format(time.RFC3339),
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return Delivery{}, reply.Err
+	}
+	if wasQueued && status != DeliveryFailed {
+		device, err := r.GetDevice(delivery.Device)
+		if err != nil {
+			r.Log.Error(err.Error())
+			return delivery, nil
+		}
+		err = r.UpdateDevicePusherLastUsed(device, delivery.Pusher)
+		if err != nil {
+			r.Log.Error(err.Error())
+		}
+	}
+	// stop instrumentation
+	return delivery, nil
+}
+
+func deliveryFromHash(id uint64, hash map[string]string) (Delivery, error) {
+	notification, err := strconv.ParseUint(hash["notification"], 10, 64)
+	if err != nil {
+		return Delivery{}, err
+	}
+	device, err := strconv.ParseUint(hash["device"], 10, 64)
+	if err != nil {
+		return Delivery{}, err
+	}
+	queued, err := time.Parse(time.RFC3339, hash["queued"])
+	if err != nil {
+		return Delivery{}, err
+	}
+	updated, err := time.Parse(time.RFC3339, hash["updated"])
+	if err != nil {
+		return Delivery{}, err
+	}
+	return Delivery{
+		ID:           id,
+		Notification: notification,
+		Device:       device,
+		Pusher:       hash["pusher"],
+		Status:       DeliveryStatus(hash["status"]),
+		Error:        hash["error"],
+		Queued:       queued,
+		Updated:      updated,
+	}, nil
+}
+
+func (r *RequestBundle) GetDelivery(id uint64) (Delivery, error) {
+	// start instrumentation
+	reply := r.Repo.client.Hgetall("deliveries:" + strconv.FormatUint(id, 10))
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return Delivery{}, reply.Err
+	}
+	if reply.Type == redis.ReplyNil {
+		return Delivery{}, DeliveryNotFoundError
+	}
+	hash, err := reply.Hash()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return Delivery{}, err
+	}
+	delivery, err := deliveryFromHash(id, hash)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return Delivery{}, err
+	}
+	// stop instrumentation
+	return delivery, nil
+}
+
+func (r *RequestBundle) GetDeliveriesByNotification(notification Notification) ([]Delivery, error) {
+	return r.getDeliveriesByKey("notifications:"+strconv.FormatUint(notification.ID, 10)+":deliveries", 0, 0, 0)
+}
+
+func (r *RequestBundle) GetDeliveriesByDevice(device Device, before, after uint64, count int) ([]Delivery, error) {
+	return r.getDeliveriesByKey("devices:"+strconv.FormatUint(device.ID, 10)+":deliveries", before, after, count)
+}
+
+func (r *RequestBundle) getDeliveriesByKey(key string, before, after uint64, count int) ([]Delivery, error) {
+	// start instrumentation
+	reply := r.Repo.client.Lrange(key, 0, -1)
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return []Delivery{}, reply.Err
+	}
+	if reply.Type == redis.ReplyNil {
+		return []Delivery{}, nil
+	}
+	ids, err := reply.List()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return []Delivery{}, err
+	}
+	ids = pageIDs(ids, before, after, count)
+	reply = r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		for _, id := range ids {
+			mc.Hgetall("deliveries:" + id)
+		}
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return []Delivery{}, reply.Err
+	}
+	deliveries := []Delivery{}
+	for pos, elem := range reply.Elems {
+		if elem.Type == redis.ReplyNil {
+			continue
+		}
+		hash, err := elem.Hash()
+		if err != nil {
+			r.Log.Error(err.Error())
+			continue
+		}
+		id, err := strconv.ParseUint(ids[pos], 10, 64)
+		if err != nil {
+			r.Log.Error(err.Error())
+			continue
+		}
+		delivery, err := deliveryFromHash(id, hash)
+		if err != nil {
+			r.Log.Error(err.Error())
+			continue
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	// stop instrumentation
+	return deliveries, nil
+}
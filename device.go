@@ -1,6 +1,9 @@
 package twocloud
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"github.com/fzzbt/radix/redis"
 	"strconv"
@@ -15,34 +18,43 @@ type Device struct {
 	LastIP     string    `json:"last_ip,omitempty"`
 	ClientType string    `json:"client_type,omitempty"`
 	Created    time.Time `json:"created,omitempty"`
-	Pushers    *Pushers  `json:"pushers,omitempty"`
+	Pushers    Pushers   `json:"pushers,omitempty"`
 	UserID     uint64    `json:"user_id,omitempty"`
 	AuthError  bool      `json:"auth_error,omitempty"`
+	PublicKey  string    `json:"public_key,omitempty"`
+	KeyPrint   string    `json:"key_fingerprint,omitempty"`
+	Presence   Presence  `json:"presence,omitempty"`
+	Dormant    bool      `json:"dormant,omitempty"`
+	// tokenHash is set on a new device so its token is stored in the
+	// same write as the device itself
+	tokenHash string
 }
 
-type Pushers struct {
-	GCM        *Pusher `json:"gcm,omitempty"`
-	WebSockets *Pusher `json:"websockets,omitempty"`
-}
+type Pushers map[string]*Pusher
 
 type Pusher struct {
 	Key      string    `json:"key,omitempty"`
 	LastUsed time.Time `json:"last_used,omitempty"`
+	Invalid  bool      `json:"invalid,omitempty"`
+	// Config can hold secrets, like a webhook's signing key, so it's never
+	// sent to clients.
+	Config map[string]string `json:"-"`
 }
 
 var InvalidClientType = errors.New("Invalid client type.")
 var InvalidPusherType = errors.New("Invalid pusher type.")
 var DeviceNotFoundError = errors.New("Device not found.")
+var InvalidPublicKeyError = errors.New("Invalid public key.")
 
-var validClientTypes = []string{"android_phone", "android_tablet", "chromebook", "macbook_chrome", "windows_chrome"}
-
+// ValidClientType reports whether the device has one of the built-in client
+// types. Use ValidClientTypeIn to include configured and stored types.
 func (d *Device) ValidClientType() bool {
-	for _, clientType := range validClientTypes {
-		if d.ClientType == clientType {
-			return true
-		}
-	}
-	return false
+	return d.ValidClientTypeIn(NewClientTypeRegistry(builtinClientTypes...))
+}
+
+func (d *Device) ValidClientTypeIn(types *ClientTypeRegistry) bool {
+	_, exists := types.Get(d.ClientType)
+	return exists
 }
 
 func (r *RequestBundle) GetDevicesByUser(user User) ([]Device, error) {
@@ -106,33 +118,22 @@ func (r *RequestBundle) GetDevicesByUser(user User) ([]Device, error) {
 			ClientType: hash["client_type"],
 			UserID:     user_id,
 			Created:    created,
-			Pushers:    &Pushers{},
 			AuthError:  autherr,
+			Dormant:    hash["dormant"] == "1",
+			PublicKey:  hash["public_key"],
+			KeyPrint:   publicKeyFingerprint(hash["public_key"]),
 		}
-		if _, exists := hash["gcm_key"]; exists {
-			device.Pushers.GCM = &Pusher{
-				Key: hash["gcm_key"],
-			}
-			if _, exists = hash["gcm_last_used"]; exists {
-				device.Pushers.GCM.LastUsed, err = time.Parse(time.RFC3339, hash["gcm_last_used"])
-				if err != nil {
-					r.Log.Error(err.Error())
-					return devices, err
-				}
-			}
-		}
-		if _, exists := hash["websockets_last_used"]; exists {
-			last_used, err := time.Parse(time.RFC3339, hash["websockets_last_used"])
-			if err != nil {
-				r.Log.Error(err.Error())
-				return devices, err
-			}
-			device.Pushers.WebSockets = &Pusher{
-				LastUsed: last_used,
-			}
+		device.Pushers, err = r.pushersFromHash(hash)
+		if err != nil {
+			r.Log.Error(err.Error())
+			return devices, err
 		}
 		devices = append(devices, device)
 	}
+	err = r.fillPresence(devices)
+	if err != nil {
+		return devices, err
+	}
 	// stop instrumentation
 	return devices, nil
 }
@@ -183,40 +184,35 @@ func (r *RequestBundle) GetDevice(id uint64) (Device, error) {
 		ClientType: hash["client_type"],
 		UserID:     user_id,
 		Created:    created,
-		Pushers:    &Pushers{},
 		AuthError:  auth_err,
+		Dormant:    hash["dormant"] == "1",
+		PublicKey:  hash["public_key"],
+		KeyPrint:   publicKeyFingerprint(hash["public_key"]),
 	}
-	if _, exists := hash["gcm_key"]; exists {
-		device.Pushers.GCM = &Pusher{
-			Key: hash["gcm_key"],
-		}
-		if _, exists = hash["gcm_last_used"]; exists {
-			device.Pushers.GCM.LastUsed, err = time.Parse(time.RFC3339, hash["gcm_last_used"])
-			if err != nil {
-				r.Log.Error(err.Error())
-				return Device{}, err
-			}
-		}
-	}
-	if _, exists := hash["websockets_last_used"]; exists {
-		last_used, err := time.Parse(time.RFC3339, hash["websockets_last_used"])
-		if err != nil {
-			r.Log.Error(err.Error())
-			return Device{}, err
-		}
-		device.Pushers.WebSockets = &Pusher{
-			LastUsed: last_used,
-		}
+	device.Pushers, err = r.pushersFromHash(hash)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return Device{}, err
 	}
 	// stop instrumentation
 	return device, nil
 }
 
+// AddDevice creates a device without handing back its token, for callers
+// that authenticate devices some other way. IssueDeviceToken gives it a
+// token it can use later.
 func (r *RequestBundle) AddDevice(name, client_type, ip, gcm_key string, user User) (Device, error) {
+	device, _, err := r.AddDeviceWithToken(name, client_type, ip, gcm_key, user)
+	return device, err
+}
+
+// AddDeviceWithToken creates a device along with its token, which is
+// returned separately and can't be recovered afterwards.
+func (r *RequestBundle) AddDeviceWithToken(name, client_type, ip, gcm_key string, user User) (Device, string, error) {
 	id, err := r.GetID()
 	if err != nil {
 		r.Log.Error(err.Error())
-		return Device{}, err
+		return Device{}, "", err
 	}
 	name = strings.TrimSpace(name)
 	client_type = strings.TrimSpace(client_type)
@@ -229,26 +225,39 @@ func (r *RequestBundle) AddDevice(name, client_type, ip, gcm_key string, user Us
 		ClientType: client_type,
 		UserID:     user.ID,
 		Created:    time.Now(),
-		Pushers: &Pushers{
-			GCM: &Pusher{
-				Key: gcm_key,
-			},
-			WebSockets: &Pusher{},
+		Pushers: Pushers{
+			PusherWebSockets: &Pusher{},
 		},
 	}
-	if !device.ValidClientType() {
-		return Device{}, InvalidClientType
+	if gcm_key != "" {
+		device.Pushers[PusherGCM] = &Pusher{
+			Key: gcm_key,
+		}
+	}
+	clientType, exists := r.clientTypes().Get(device.ClientType)
+	if !exists {
+		return Device{}, "", InvalidClientType
+	}
+	if clientType.Deprecated {
+		return Device{}, "", DeprecatedClientTypeError
 	}
+	token, err := GenerateSecret()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return Device{}, "", err
+	}
+	device.tokenHash = hashDeviceToken(token)
 	err = r.storeDevice(device, false)
 	// add repo calls to instrumentation
 	if err != nil {
 		r.Log.Error(err.Error())
-		return Device{}, err
+		return Device{}, "", err
 	}
+	device.tokenHash = ""
 	// log the device creation in stats
 	// add repo calls to instrumentation
 	// stop instrumentation
-	return device, nil
+	return device, token, nil
 }
 
 func (r *RequestBundle) storeDevice(device Device, update bool) error {
@@ -273,9 +282,24 @@ func (r *RequestBundle) storeDevice(device Device, update bool) error {
 			changes["client_type"] = device.ClientType
 			from["client_type"] = old_device.ClientType
 		}
-		if old_device.Pushers != nil && old_device.Pushers.GCM != nil && device.Pushers != nil && device.Pushers.GCM != nil && old_device.Pushers.GCM.Key != device.Pushers.GCM.Key {
-			changes["gcm_key"] = device.Pushers.GCM.Key
-			from["gcm_key"] = old_device.Pushers.GCM.Key
+		for name, pusher := range device.Pushers {
+			to, err := pusherHash(name, pusher)
+			if err != nil {
+				return err
+			}
+			was := map[string]interface{}{}
+			if old_pusher, exists := old_device.Pushers[name]; exists {
+				was, err = pusherHash(name, old_pusher)
+				if err != nil {
+					return err
+				}
+			}
+			for field, value := range to {
+				if was[field] != value {
+					changes[field] = value
+					from[field] = was[field]
+				}
+			}
 		}
 		reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
 			mc.Hmset("devices:"+strconv.FormatUint(device.ID, 10), changes)
@@ -305,17 +329,47 @@ func (r *RequestBundle) storeDevice(device Device, update bool) error {
 		"created":     "",
 		"user_id":     "",
 	}
-	if device.Pushers != nil && device.Pushers.GCM != nil {
-		changes["gcm_key"] = device.Pushers.GCM.Key
-		from["gcm_key"] = ""
+	for name, pusher := range device.Pushers {
+		fields, err := pusherHash(name, pusher)
+		if err != nil {
+			return err
+		}
+		for field, value := range fields {
+			changes[field] = value
+			from[field] = ""
+		}
+	}
+	if device.tokenHash != "" {
+		changes["token_hash"] = device.tokenHash
+		changes["token_issued"] = time.Now().Format(time.RFC3339)
+		changes["token_last_used"] = ""
+		from["token_hash"] = ""
+		from["token_issued"] = ""
+		from["token_last_used"] = ""
 	}
+	key := "devices:" + strconv.FormatUint(device.ID, 10)
+	devicesKey := "users:" + strconv.FormatUint(device.UserID, 10) + ":devices"
 	reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
-		mc.Hmset("devices:"+strconv.FormatUint(device.ID, 10), changes)
-		mc.Zadd("users:"+strconv.FormatUint(device.UserID, 10)+":devices", device.LastSeen.Unix(), device.ID)
+		mc.Hmset(key, changes)
+		mc.Zadd(devicesKey, device.LastSeen.Unix(), device.ID)
+		if device.tokenHash != "" {
+			mc.Hset("device_tokens", device.tokenHash, device.ID)
+		}
 	})
 	// add repo call to instrumentation
 	if reply.Err != nil {
 		r.Log.Error(reply.Err.Error())
+		// don't leave a device behind that can't sign in
+		rollback := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+			mc.Del(key)
+			mc.Zrem(devicesKey, device.ID)
+			if device.tokenHash != "" {
+				mc.Hdel("device_tokens", device.tokenHash)
+			}
+		})
+		if rollback.Err != nil {
+			r.Log.Error(rollback.Err.Error())
+		}
 		return reply.Err
 	}
 	r.AuditMap("devices:"+strconv.FormatUint(device.ID, 10), from, changes)
@@ -331,26 +385,26 @@ func (r *RequestBundle) UpdateDevice(device Device, name, client_type, gcm_key s
 		device.Name = name
 	}
 	client_type = strings.TrimSpace(client_type)
-	if client_type != "" {
+	if client_type != "" && client_type != device.ClientType {
+		if clientType, exists := r.clientTypes().Get(client_type); exists && clientType.Deprecated {
+			return Device{}, DeprecatedClientTypeError
+		}
 		device.ClientType = client_type
 	}
 	gcm_key = strings.TrimSpace(gcm_key)
 	if gcm_key != "" {
 		if device.Pushers == nil {
-			device.Pushers = &Pushers{
-				GCM: &Pusher{
-					Key: gcm_key,
-				},
-			}
-		} else if device.Pushers.GCM == nil {
-			device.Pushers.GCM = &Pusher{
-				Key: gcm_key,
-			}
-		} else {
-			device.Pushers.GCM.Key = gcm_key
+			device.Pushers = Pushers{}
 		}
+		pusher := &Pusher{
+			Key: gcm_key,
+		}
+		if old, exists := device.Pushers[PusherGCM]; exists {
+			pusher.LastUsed = old.LastUsed
+		}
+		device.Pushers[PusherGCM] = pusher
 	}
-	if !device.ValidClientType() {
+	if !device.ValidClientTypeIn(r.clientTypes()) {
 		r.Log.Debug("Invalid client type: %s", device.ClientType)
 		return Device{}, InvalidClientType
 	}
@@ -368,23 +422,37 @@ func (r *RequestBundle) UpdateDevice(device Device, name, client_type, gcm_key s
 
 func (r *RequestBundle) UpdateDeviceLastSeen(device Device, ip string) (Device, error) {
 	now := time.Now()
-	reply := r.Repo.client.Hmset("devices:"+strconv.FormatUint(device.ID, 10), "last_seen", now.Format(time.RFC3339), "last_ip", ip)
-	// add repo call to instrumentation
-	if reply.Err != nil {
-		return Device{}, reply.Err
+	changes := map[string]interface{}{
+		"last_seen": now.Format(time.RFC3339),
+		"last_ip":   ip,
 	}
 	from := map[string]interface{}{
 		"last_seen": device.LastSeen.Format(time.RFC3339),
 		"last_ip":   device.LastIP,
 	}
+	// a device that shows up again is no longer dormant
+	if device.Dormant {
+		changes["dormant"] = boolString(false)
+		from["dormant"] = boolString(true)
+	}
+	reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		mc.Hmset("devices:"+strconv.FormatUint(device.ID, 10), changes)
+		mc.Zadd("users:"+strconv.FormatUint(device.UserID, 10)+":devices", now.Unix(), device.ID)
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		return Device{}, reply.Err
+	}
 	device.LastSeen = now
 	device.LastIP = ip
-	to := map[string]interface{}{
-		"last_seen": now.Format(time.RFC3339),
-		"last_ip":   ip,
-	}
+	device.Dormant = false
+	to := changes
 	r.AuditMap("devices:"+strconv.FormatUint(device.ID, 10), from, to)
 	// add repo call to instrumentation
+	err := r.TouchDevicePresence(device)
+	if err != nil {
+		r.Log.Error(err.Error())
+	}
 	// stop instrumentation
 	return device, nil
 }
@@ -394,24 +462,36 @@ func (r *RequestBundle) UpdateDeviceGCMLastUsed(device Device) error {
 }
 
 func (r *RequestBundle) UpdateDeviceWebSocketLastUsed(device Device) error {
-	return r.updateDevicePusherLastUsed(device, "websocket")
+	return r.updateDevicePusherLastUsed(device, "websockets")
+}
+
+func (r *RequestBundle) UpdateDeviceSSELastUsed(device Device) error {
+	return r.updateDevicePusherLastUsed(device, "sse")
+}
+
+// UpdateDevicePusherLastUsed records that a device was just reached through
+// a pusher, going through the pusher's own method where it has one.
+func (r *RequestBundle) UpdateDevicePusherLastUsed(device Device, pusher string) error {
+	switch pusher {
+	case PusherGCM:
+		return r.UpdateDeviceGCMLastUsed(device)
+	case PusherWebSockets:
+		return r.UpdateDeviceWebSocketLastUsed(device)
+	case PusherSSE:
+		return r.UpdateDeviceSSELastUsed(device)
+	}
+	return r.updateDevicePusherLastUsed(device, pusher)
 }
 
 func (r *RequestBundle) updateDevicePusherLastUsed(device Device, pusher string) error {
 	// start instrumentation
-	if pusher != "gcm" && pusher != "websockets" {
+	if _, exists := r.pusherRegistry().Get(pusher); !exists {
 		return InvalidPusherType
 	}
 	var was time.Time
 	now := time.Now()
-	if pusher == "gcm" {
-		if device.Pushers != nil && device.Pushers.GCM != nil {
-			was = device.Pushers.GCM.LastUsed
-		}
-	} else if pusher == "websockets" {
-		if device.Pushers != nil && device.Pushers.WebSockets != nil {
-			was = device.Pushers.WebSockets.LastUsed
-		}
+	if old, exists := device.Pushers[pusher]; exists {
+		was = old.LastUsed
 	}
 	reply := r.Repo.client.Hset("devices:"+strconv.FormatUint(device.ID, 10), pusher+"_last_used", now.Format(time.RFC3339))
 	// add repo call to instrumentation
@@ -425,6 +505,57 @@ func (r *RequestBundle) updateDevicePusherLastUsed(device Device, pusher string)
 	return nil
 }
 
+func publicKeyFingerprint(key string) string {
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (r *RequestBundle) RegisterDeviceKey(device Device, key string) (Device, error) {
+	// start instrumentation
+	key = strings.TrimSpace(key)
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded) < 32 {
+		return Device{}, InvalidPublicKeyError
+	}
+	if device.PublicKey == key {
+		return device, nil
+	}
+	reply := r.Repo.client.Hset("devices:"+strconv.FormatUint(device.ID, 10), "public_key", key)
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return Device{}, reply.Err
+	}
+	r.Audit("devices:"+strconv.FormatUint(device.ID, 10), "public_key", device.PublicKey, key)
+	// add repo call to instrumentation
+	device.PublicKey = key
+	device.KeyPrint = publicKeyFingerprint(key)
+	// stop instrumentation
+	return device, nil
+}
+
+func (r *RequestBundle) RevokeDeviceKey(device Device) (Device, error) {
+	// start instrumentation
+	if device.PublicKey == "" {
+		return device, nil
+	}
+	reply := r.Repo.client.Hdel("devices:"+strconv.FormatUint(device.ID, 10), "public_key")
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return Device{}, reply.Err
+	}
+	r.Audit("devices:"+strconv.FormatUint(device.ID, 10), "public_key", device.PublicKey, "")
+	// add repo call to instrumentation
+	device.PublicKey = ""
+	device.KeyPrint = ""
+	// stop instrumentation
+	return device, nil
+}
+
 func (r *RequestBundle) updateAuthErrorFlag(value bool) error {
 	// start instrumetnation
 	if r.Device.ID == 0 {
@@ -445,6 +576,111 @@ func (r *RequestBundle) updateAuthErrorFlag(value bool) error {
 	return nil
 }
 
+// deleteDeviceScript removes a device and everything hanging off it in one
+// step. Links the device received while they were unread are dropped from
+// its owner's unread list, and notifications addressed to the device alone
+// are deleted; links themselves are kept in the user's lists as history.
+// Every step is idempotent, so running the script again after a failure
+// just finishes the job. It returns the groups the device was removed from.
+const deleteDeviceScript = `
+local device, user = ARGV[1], ARGV[2]
+local dkey, ukey = 'devices:' .. device, 'users:' .. user
+local unread_links = 0
+for _, id in ipairs(redis.call('LRANGE', dkey .. ':links:unread', 0, -1)) do
+	unread_links = unread_links + redis.call('LREM', ukey .. ':links:unread', 0, id)
+end
+for _, list in ipairs({':links:sent', ':links:received'}) do
+	for _, id in ipairs(redis.call('LRANGE', dkey .. list, 0, -1)) do
+		redis.call('SREM', 'links:' .. id .. ':participants', device)
+	end
+end
+local unread_notifications = 0
+for _, list in ipairs({':notifications', ':notifications:hidden'}) do
+	for _, id in ipairs(redis.call('LRANGE', dkey .. list, 0, -1)) do
+		local nkey = 'notifications:' .. id
+		if redis.call('HGET', nkey, 'destination_type') == 'device' then
+			redis.call('LREM', ukey .. ':notifications', 0, id)
+			redis.call('LREM', ukey .. ':notifications:hidden', 0, id)
+			redis.call('LREM', ukey .. ':notifications:digest', 0, id)
+			unread_notifications = unread_notifications + redis.call('LREM', ukey .. ':notifications:unread', 0, id)
+			redis.call('ZREM', 'notifications_by_expiration', id)
+			redis.call('DEL', nkey, nkey .. ':deliveries')
+		end
+	end
+end
+if unread_links > 0 then
+	redis.call('HINCRBY', ukey .. ':unread_counts', 'links', -unread_links)
+end
+if unread_notifications > 0 then
+	redis.call('HINCRBY', ukey .. ':unread_counts', 'notifications', -unread_notifications)
+end
+redis.call('DEL', dkey .. ':links:sent', dkey .. ':links:received', dkey .. ':links:unread',
+	dkey .. ':notifications', dkey .. ':notifications:unread', dkey .. ':notifications:hidden',
+	dkey .. ':notifications:collapse',
+	dkey .. ':unread_counts', dkey .. ':replies:unread', dkey .. ':deliveries',
+	dkey .. ':presence:online', dkey .. ':presence:idle')
+redis.call('ZREM', 'presence_due', device)
+local token = redis.call('HGET', dkey, 'token_hash')
+if token then
+	redis.call('HDEL', 'device_tokens', token)
+end
+local groups = redis.call('SMEMBERS', dkey .. ':groups')
+for _, id in ipairs(groups) do
+	redis.call('SREM', 'device_groups:' .. id .. ':devices', device)
+end
+redis.call('DEL', dkey .. ':groups')
+redis.call('ZREM', ukey .. ':devices', device)
+redis.call('DEL', dkey)
+return groups
+`
+
 func (r *RequestBundle) DeleteDevice(device Device) error {
+	// start instrumentation
+	from := map[string]interface{}{
+		"name":        device.Name,
+		"last_seen":   device.LastSeen.Format(time.RFC3339),
+		"last_ip":     device.LastIP,
+		"client_type": device.ClientType,
+		"created":     device.Created.Format(time.RFC3339),
+		"user_id":     device.UserID,
+		"public_key":  device.PublicKey,
+	}
+	to := map[string]interface{}{
+		"name":        "",
+		"last_seen":   "",
+		"last_ip":     "",
+		"client_type": "",
+		"created":     "",
+		"user_id":     "",
+		"public_key":  "",
+	}
+	for name, pusher := range device.Pushers {
+		fields, err := pusherHash(name, pusher)
+		if err != nil {
+			return err
+		}
+		for field, value := range fields {
+			from[field] = value
+			to[field] = ""
+		}
+	}
+	reply := r.Repo.client.Eval(deleteDeviceScript, 0, device.ID, device.UserID)
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return reply.Err
+	}
+	r.AuditMap("devices:"+strconv.FormatUint(device.ID, 10), from, to)
+	// add repo call to instrumentation
+	groups, err := reply.List()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return nil
+	}
+	for _, group := range groups {
+		r.Audit("device_groups:"+group+":devices", strconv.FormatUint(device.ID, 10), "1", "")
+		// add repo call to instrumentation
+	}
+	// stop instrumentation
 	return nil
 }
@@ -0,0 +1,282 @@
+package twocloud
+
+import (
+	"bytes"
+	"github.com/fzzbt/radix/redis"
+	htmltemplate "html/template"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+type Digest struct {
+	User          User           `json:"user,omitempty"`
+	Since         time.Time      `json:"since,omitempty"`
+	Links         []DigestLink   `json:"links,omitempty"`
+	Notifications []Notification `json:"notifications,omitempty"`
+}
+
+type DigestLink struct {
+	Link    Link   `json:"link,omitempty"`
+	Summary string `json:"summary,omitempty"`
+}
+
+func (d Digest) IsEmpty() bool {
+	return len(d.Links) < 1 && len(d.Notifications) < 1
+}
+
+const digestText = `Hi {{.User.Username}},
+
+Here's what you missed on 2cloud since {{.Since.Format "January 2"}}.
+{{if .Links}}
+Unread links:
+{{range .Links}}
+ * {{.Summary}}{{if .Link.Sender.Name}} (from {{.Link.Sender.Name}}){{end}}{{if .Link.Comment}}
+   {{.Link.Comment}}{{end}}
+{{end}}{{end}}{{if .Notifications}}
+Notifications:
+{{range .Notifications}}
+ * {{.Body}}
+{{end}}{{end}}
+You're getting this email because you asked for 2cloud digests. You can
+change how often they're sent in your notification preferences.
+`
+
+const digestHTML = `<html>
+<body>
+<p>Hi {{.User.Username}},</p>
+<p>Here's what you missed on 2cloud since {{.Since.Format "January 2"}}.</p>
+{{if .Links}}<h2>Unread links</h2>
+<ul>
+{{range .Links}}<li>{{if .Link.URL}}<a href="{{.Link.URL.Address}}">{{.Summary}}</a>{{else}}{{.Summary}}{{end}}{{if .Link.Sender.Name}} (from {{.Link.Sender.Name}}){{end}}{{if .Link.Comment}}<br>{{.Link.Comment}}{{end}}</li>
+{{end}}</ul>
+{{end}}{{if .Notifications}}<h2>Notifications</h2>
+<ul>
+{{range .Notifications}}<li>{{.Body}}</li>
+{{end}}</ul>
+{{end}}<p>You're getting this email because you asked for 2cloud digests. You can change how often they're sent in your notification preferences.</p>
+</body>
+</html>
+`
+
+var digestTextTemplate = template.Must(template.New("digest").Parse(digestText))
+var digestHTMLTemplate = htmltemplate.Must(htmltemplate.New("digest").Parse(digestHTML))
+
+func digestLinkSummary(link Link) string {
+	if link.Encrypted {
+		return "An encrypted " + string(link.Kind)
+	}
+	if link.URL != nil {
+		return link.URL.Address
+	}
+	if link.Payload != nil {
+		if link.Payload.FileName != "" {
+			return link.Payload.FileName
+		}
+		return link.Payload.Text
+	}
+	return string(link.Kind)
+}
+
+func (d Digest) Render() (string, string, error) {
+	text := &bytes.Buffer{}
+	err := digestTextTemplate.Execute(text, d)
+	if err != nil {
+		return "", "", err
+	}
+	html := &bytes.Buffer{}
+	err = digestHTMLTemplate.Execute(html, d)
+	if err != nil {
+		return "", "", err
+	}
+	return text.String(), html.String(), nil
+}
+
+func (r *RequestBundle) getUnreadLinksSince(user User, since time.Time) ([]Link, error) {
+	links, err := r.getLinksByKey("users:"+strconv.FormatUint(user.ID, 10)+":links:unread", 0, 0, 0)
+	if err != nil {
+		return []Link{}, err
+	}
+	recent := []Link{}
+	for _, link := range links {
+		if link.Sent.After(since) {
+			recent = append(recent, link)
+		}
+	}
+	return recent, nil
+}
+
+// BuildDigest collects the unread links and notifications a user has
+// received since their last digest. Notifications are only included when
+// the user has the email channel enabled for their nature, or when they
+// were sent at low priority and so were never pushed.
+func (r *RequestBundle) BuildDigest(user User, preferences NotificationPreferences) (Digest, error) {
+	// start instrumentation
+	since := user.LastDigest
+	if since.IsZero() {
+		since = time.Now().Add(-preferences.Digest.Period())
+	}
+	digest := Digest{
+		User:          user,
+		Since:         since,
+		Links:         []DigestLink{},
+		Notifications: []Notification{},
+	}
+	links, err := r.getUnreadLinksSince(user, since)
+	if err != nil {
+		return Digest{}, err
+	}
+	for _, link := range links {
+		digest.Links = append(digest.Links, DigestLink{
+			Link:    link,
+			Summary: digestLinkSummary(link),
+		})
+	}
+	notifications, err := r.getNotificationsByKey("users:"+strconv.FormatUint(user.ID, 10)+":notifications:digest", 0, 0, 0)
+	if err != nil {
+		return Digest{}, err
+	}
+	locale, looked := "", false
+	for _, notification := range notifications {
+		if !notification.Unread || !notification.Sent.After(since) {
+			continue
+		}
+		if notification.Templated && !looked {
+			locale = r.getUserLocale(user.ID)
+			looked = true
+		}
+		digest.Notifications = append(digest.Notifications, r.localizeNotification(notification, locale))
+	}
+	// stop instrumentation
+	return digest, nil
+}
+
+func (r *RequestBundle) SendDigest(user User, preferences NotificationPreferences) (bool, error) {
+	// start instrumentation
+	if r.Mailer == nil {
+		return false, NoMailTransportError
+	}
+	if user.Email == "" || user.EmailUnconfirmed {
+		return false, nil
+	}
+	digest, err := r.BuildDigest(user, preferences)
+	if err != nil {
+		return false, err
+	}
+	if digest.IsEmpty() {
+		return false, nil
+	}
+	text, html, err := digest.Render()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return false, err
+	}
+	subject := "Your 2cloud daily digest"
+	if preferences.Digest == DigestWeekly {
+		subject = "Your 2cloud weekly digest"
+	}
+	err = r.Mailer.Send(MailMessage{
+		From:    r.Config.DigestSender,
+		To:      user.Email,
+		Subject: subject,
+		Text:    text,
+		HTML:    html,
+	})
+	// add mailer call to instrumentation
+	if err != nil {
+		r.Log.Error(err.Error())
+		return false, err
+	}
+	// stop instrumentation
+	return true, nil
+}
+
+func (r *RequestBundle) recordDigest(user User, schedule DigestSchedule, sent time.Time, delivered bool) error {
+	key := "users:" + strconv.FormatUint(user.ID, 10)
+	reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		if delivered {
+			mc.Hset(key, "last_digest", sent.Format(time.RFC3339))
+		}
+		mc.Zadd("digests_due", sent.Add(schedule.Period()).Unix(), user.ID)
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return reply.Err
+	}
+	if delivered {
+		from := ""
+		if !user.LastDigest.IsZero() {
+			from = user.LastDigest.Format(time.RFC3339)
+		}
+		r.Audit(key, "last_digest", from, sent.Format(time.RFC3339))
+		// add repo call to instrumentation
+	}
+	return nil
+}
+
+// SendDueDigests sends a digest to every user whose schedule has come due,
+// then schedules their next one. Users who turned digests off since they
+// were scheduled are dropped from the schedule. A user whose digest fails
+// to send stays due and is retried on the next run.
+func (r *RequestBundle) SendDueDigests() (int, error) {
+	// start instrumentation
+	now := time.Now()
+	reply := r.Repo.client.Zrangebyscore("digests_due", "-inf", now.Unix())
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return 0, reply.Err
+	}
+	if reply.Type == redis.ReplyNil {
+		return 0, nil
+	}
+	ids, err := reply.List()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return 0, err
+	}
+	sent := 0
+	var lastErr error
+	for _, idstr := range ids {
+		id, err := strconv.ParseUint(idstr, 10, 64)
+		if err != nil {
+			r.Log.Error(err.Error())
+			continue
+		}
+		user, err := r.GetUser(id)
+		if err == UserNotFoundError {
+			r.Repo.client.Zrem("digests_due", id)
+			// add repo call to instrumentation
+			continue
+		} else if err != nil {
+			lastErr = err
+			continue
+		}
+		preferences, err := r.GetNotificationPreferences(user)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if preferences.Digest == DigestNever {
+			r.Repo.client.Zrem("digests_due", id)
+			// add repo call to instrumentation
+			continue
+		}
+		delivered, err := r.SendDigest(user, preferences)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		err = r.recordDigest(user, preferences.Digest, now, delivered)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if delivered {
+			sent++
+		}
+	}
+	// stop instrumentation
+	return sent, lastErr
+}
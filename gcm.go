@@ -0,0 +1,323 @@
+package twocloud
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultGCMEndpoint = "https://fcm.googleapis.com/fcm/send"
+const defaultGCMRetries = 5
+const defaultGCMBackoff = time.Second
+
+// maxGCMRetryAfter caps how long a Retry-After header can hold up a push.
+const maxGCMRetryAfter = time.Minute
+
+type GCMMessage struct {
+	RegistrationIDs []string          `json:"registration_ids"`
+	Data            map[string]string `json:"data,omitempty"`
+	CollapseKey     string            `json:"collapse_key,omitempty"`
+	TimeToLive      int64             `json:"time_to_live,omitempty"`
+	Priority        string            `json:"priority,omitempty"`
+}
+
+type GCMResult struct {
+	MessageID      string `json:"message_id,omitempty"`
+	RegistrationID string `json:"registration_id,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+type gcmResponse struct {
+	Success      int         `json:"success"`
+	Failure      int         `json:"failure"`
+	CanonicalIDs int         `json:"canonical_ids"`
+	Results      []GCMResult `json:"results"`
+}
+
+var GCMAuthError = errors.New("The push server rejected our API key.")
+var NoGCMClientError = errors.New("No GCM client is configured.")
+var NoGCMKeyError = errors.New("The device has no valid GCM registration.")
+var GCMRegistrationInvalidError = errors.New("The device's GCM registration is no longer valid.")
+
+type GCMError string
+
+func (err GCMError) Error() string {
+	return "The push server returned an error: " + string(err)
+}
+
+type GCMRequestError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *GCMRequestError) Error() string {
+	return "The push server responded with status " + strconv.Itoa(e.StatusCode) + ": " + e.Body
+}
+
+type GCMClient struct {
+	Endpoint       string
+	APIKey         string
+	MaxRetries     int
+	InitialBackoff time.Duration
+	HTTPClient     *http.Client
+}
+
+// NewGCMClient builds a client from config, where the initial backoff is
+// given in milliseconds. Pointing the endpoint at a local server is enough
+// to test against a fake.
+func NewGCMClient(config GCMConfig) *GCMClient {
+	client := &GCMClient{
+		Endpoint:       config.Endpoint,
+		APIKey:         config.APIKey,
+		MaxRetries:     config.MaxRetries,
+		InitialBackoff: time.Millisecond * config.InitialBackoff,
+		HTTPClient:     &http.Client{Timeout: time.Second * 30},
+	}
+	if client.Endpoint == "" {
+		client.Endpoint = defaultGCMEndpoint
+	}
+	if client.MaxRetries < 1 {
+		client.MaxRetries = defaultGCMRetries
+	}
+	if client.InitialBackoff <= 0 {
+		client.InitialBackoff = defaultGCMBackoff
+	}
+	return client
+}
+
+func gcmShouldRetry(result GCMResult) bool {
+	return result.Error == "Unavailable" || result.Error == "InternalServerError"
+}
+
+// retryAfter reads a Retry-After header given either as a number of seconds
+// or as an HTTP date, up to maxGCMRetryAfter.
+func retryAfter(resp *http.Response) time.Duration {
+	wait := requestedRetryAfter(resp)
+	if wait > maxGCMRetryAfter {
+		return maxGCMRetryAfter
+	}
+	return wait
+}
+
+func requestedRetryAfter(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return 0
+	}
+	seconds, err := strconv.Atoi(header)
+	if err == nil {
+		return time.Second * time.Duration(seconds)
+	}
+	when, err := http.ParseTime(header)
+	if err != nil {
+		return 0
+	}
+	return when.Sub(time.Now())
+}
+
+func (c *GCMClient) post(message GCMMessage) (*http.Response, []byte, error) {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest("POST", c.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Authorization", "key="+c.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp, nil, err
+	}
+	return resp, contents, nil
+}
+
+// Send delivers a message to each of its registration IDs and returns the
+// result for each, keyed by the registration ID it was sent to. Registration
+// IDs the server couldn't handle right now are retried with exponential
+// backoff, waiting at least as long as any Retry-After header asks. IDs that
+// are still failing when the retries run out keep their last error.
+func (c *GCMClient) Send(message GCMMessage) (map[string]GCMResult, error) {
+	results := map[string]GCMResult{}
+	pending := message.RegistrationIDs
+	backoff := c.InitialBackoff
+	var lastErr error
+	for attempt := 0; attempt <= c.MaxRetries && len(pending) > 0; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff + time.Duration(rand.Int63n(int64(backoff)/2+1)))
+			backoff *= 2
+		}
+		message.RegistrationIDs = pending
+		resp, body, err := c.post(message)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode == http.StatusUnauthorized {
+			return results, GCMAuthError
+		}
+		if resp.StatusCode >= 500 {
+			lastErr = &GCMRequestError{StatusCode: resp.StatusCode, Body: string(body)}
+			if wait := retryAfter(resp); wait > backoff {
+				backoff = wait
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return results, &GCMRequestError{StatusCode: resp.StatusCode, Body: string(body)}
+		}
+		var response gcmResponse
+		err = json.Unmarshal(body, &response)
+		if err != nil {
+			return results, err
+		}
+		retry := []string{}
+		for pos, result := range response.Results {
+			if pos >= len(pending) {
+				break
+			}
+			results[pending[pos]] = result
+			if gcmShouldRetry(result) {
+				retry = append(retry, pending[pos])
+			}
+		}
+		pending = retry
+		lastErr = nil
+		if wait := retryAfter(resp); wait > backoff {
+			backoff = wait
+		}
+	}
+	if lastErr != nil && len(results) < 1 {
+		return results, lastErr
+	}
+	return results, nil
+}
+
+func (r *RequestBundle) pushGCM(device Device, message GCMMessage) (GCMResult, error) {
+	// start instrumentation
+	if r.GCM == nil {
+		return GCMResult{}, NoGCMClientError
+	}
+	pusher, exists := device.Pushers[PusherGCM]
+	if !exists || pusher.Key == "" || pusher.Invalid {
+		return GCMResult{}, NoGCMKeyError
+	}
+	key := pusher.Key
+	message.RegistrationIDs = []string{key}
+	results, err := r.GCM.Send(message)
+	// add push call to instrumentation
+	if err != nil {
+		r.Log.Error(err.Error())
+		return GCMResult{}, err
+	}
+	result, found := results[key]
+	if !found {
+		return GCMResult{}, GCMError("NoResult")
+	}
+	switch result.Error {
+	case "":
+		if result.RegistrationID != "" && result.RegistrationID != key {
+			err = r.updateGCMKey(device, result.RegistrationID)
+			if err != nil {
+				r.Log.Error(err.Error())
+			}
+		}
+	case "NotRegistered", "InvalidRegistration":
+		err = r.invalidateGCMKey(device)
+		if err != nil {
+			r.Log.Error(err.Error())
+		}
+		return result, GCMRegistrationInvalidError
+	default:
+		return result, GCMError(result.Error)
+	}
+	// stop instrumentation
+	return result, nil
+}
+
+func (r *RequestBundle) updateGCMKey(device Device, key string) error {
+	reply := r.Repo.client.Hset("devices:"+strconv.FormatUint(device.ID, 10), "gcm_key", key)
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return reply.Err
+	}
+	from := ""
+	if pusher, exists := device.Pushers[PusherGCM]; exists {
+		from = pusher.Key
+	}
+	r.Audit("devices:"+strconv.FormatUint(device.ID, 10), "gcm_key", from, key)
+	// add repo call to instrumentation
+	return nil
+}
+
+func (r *RequestBundle) invalidateGCMKey(device Device) error {
+	changes := map[string]interface{}{
+		"gcm_key":     "",
+		"gcm_invalid": "1",
+	}
+	from := map[string]interface{}{
+		"gcm_key":     "",
+		"gcm_invalid": "0",
+	}
+	if pusher, exists := device.Pushers[PusherGCM]; exists {
+		from["gcm_key"] = pusher.Key
+	}
+	reply := r.Repo.client.Hmset("devices:"+strconv.FormatUint(device.ID, 10), changes)
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return reply.Err
+	}
+	r.AuditMap("devices:"+strconv.FormatUint(device.ID, 10), from, changes)
+	// add repo call to instrumentation
+	return nil
+}
+
+func notificationGCMMessage(notification Notification) GCMMessage {
+	message := GCMMessage{
+		Data: map[string]string{
+			"type":   "notification",
+			"id":     strconv.FormatUint(notification.ID, 10),
+			"nature": notification.Nature,
+			"body":   notification.Body,
+		},
+		CollapseKey: notification.CollapseKey,
+		Priority:    "normal",
+	}
+	if notification.Priority == PriorityHigh {
+		message.Priority = "high"
+	}
+	if !notification.Expires.IsZero() {
+		message.TimeToLive = int64(notification.Expires.Sub(time.Now()).Seconds())
+	}
+	return message
+}
+
+// linkGCMMessage only tells the receiving device which link to fetch, so
+// payloads never have to fit within the push server's size limit.
+func linkGCMMessage(link Link) GCMMessage {
+	return GCMMessage{
+		Data: map[string]string{
+			"type":   "link",
+			"id":     strconv.FormatUint(link.ID, 10),
+			"kind":   string(link.Kind),
+			"sender": strconv.FormatUint(link.Sender.ID, 10),
+		},
+		Priority: "high",
+	}
+}
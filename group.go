@@ -0,0 +1,378 @@
+package twocloud
+
+import (
+	"errors"
+	"github.com/fzzbt/radix/redis"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type DeviceGroup struct {
+	ID      uint64    `json:"id,omitempty"`
+	Name    string    `json:"name,omitempty"`
+	UserID  uint64    `json:"user_id,omitempty"`
+	Created time.Time `json:"created,omitempty"`
+	Devices []uint64  `json:"devices,omitempty"`
+}
+
+var DeviceGroupNotFoundError = errors.New("Device group not found.")
+var InvalidDeviceGroupNameError = errors.New("Device group names must be between 1 and 50 characters long.")
+var DeviceGroupNameTakenError = errors.New("You already have a device group with that name.")
+var DeviceGroupOwnerError = errors.New("Only the group owner's devices can be added to a device group.")
+var DeviceGroupSenderError = errors.New("Only the group owner's devices can send links to a device group.")
+var EncryptedGroupLinkError = errors.New("Encrypted links are encrypted for a single device and can't be sent to a group.")
+
+// Device groups are stored in device_groups:<id>, with their members in
+// device_groups:<id>:devices. users:<id>:groups maps the lowercased names of
+// a user's groups to their IDs, and devices:<id>:groups lists the groups a
+// device belongs to, so they can be cleaned up when it's deleted.
+
+func groupMembersKey(group uint64) string {
+	return "device_groups:" + strconv.FormatUint(group, 10) + ":devices"
+}
+
+func (r *RequestBundle) CreateDeviceGroup(user User, name string) (DeviceGroup, error) {
+	// start instrumentation
+	name = strings.TrimSpace(name)
+	if len(name) < 1 || len(name) > 50 {
+		return DeviceGroup{}, InvalidDeviceGroupNameError
+	}
+	id, err := r.GetID()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return DeviceGroup{}, err
+	}
+	group := DeviceGroup{
+		ID:      id,
+		Name:    name,
+		UserID:  user.ID,
+		Created: time.Now(),
+		Devices: []uint64{},
+	}
+	reply := r.Repo.client.Hsetnx("users:"+strconv.FormatUint(user.ID, 10)+":groups", strings.ToLower(name), id)
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return DeviceGroup{}, reply.Err
+	}
+	set, err := reply.Bool()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return DeviceGroup{}, err
+	}
+	if !set {
+		return DeviceGroup{}, DeviceGroupNameTakenError
+	}
+	changes := map[string]interface{}{
+		"name":    group.Name,
+		"user_id": group.UserID,
+		"created": group.Created.Format(time.RFC3339),
+	}
+	from := map[string]interface{}{
+		"name":    "",
+		"user_id": "",
+		"created": "",
+	}
+	reply = r.Repo.client.Hmset("device_groups:"+strconv.FormatUint(id, 10), changes)
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		r.Repo.client.Hdel("users:"+strconv.FormatUint(user.ID, 10)+":groups", strings.ToLower(name))
+		// add repo call to instrumentation
+		return DeviceGroup{}, reply.Err
+	}
+	r.AuditMap("device_groups:"+strconv.FormatUint(id, 10), from, changes)
+	// add repo call to instrumentation
+	// stop instrumentation
+	return group, nil
+}
+
+func (r *RequestBundle) GetDeviceGroup(id uint64) (DeviceGroup, error) {
+	// start instrumentation
+	reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		mc.Hgetall("device_groups:" + strconv.FormatUint(id, 10))
+		mc.Smembers(groupMembersKey(id))
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return DeviceGroup{}, reply.Err
+	}
+	if reply.Elems[0].Type == redis.ReplyNil {
+		return DeviceGroup{}, DeviceGroupNotFoundError
+	}
+	hash, err := reply.Elems[0].Hash()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return DeviceGroup{}, err
+	}
+	if len(hash) < 1 {
+		return DeviceGroup{}, DeviceGroupNotFoundError
+	}
+	members := []string{}
+	if reply.Elems[1].Type != redis.ReplyNil {
+		members, err = reply.Elems[1].List()
+		if err != nil {
+			r.Log.Error(err.Error())
+			return DeviceGroup{}, err
+		}
+	}
+	group, err := deviceGroupFromHash(id, hash, members)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return DeviceGroup{}, err
+	}
+	// stop instrumentation
+	return group, nil
+}
+
+func deviceGroupFromHash(id uint64, hash map[string]string, members []string) (DeviceGroup, error) {
+	user, err := strconv.ParseUint(hash["user_id"], 10, 64)
+	if err != nil {
+		return DeviceGroup{}, err
+	}
+	created, err := time.Parse(time.RFC3339, hash["created"])
+	if err != nil {
+		return DeviceGroup{}, err
+	}
+	group := DeviceGroup{
+		ID:      id,
+		Name:    hash["name"],
+		UserID:  user,
+		Created: created,
+		Devices: []uint64{},
+	}
+	for _, member := range members {
+		device, err := strconv.ParseUint(member, 10, 64)
+		if err != nil {
+			return DeviceGroup{}, err
+		}
+		group.Devices = append(group.Devices, device)
+	}
+	return group, nil
+}
+
+func (r *RequestBundle) GetDeviceGroupsByUser(user User) ([]DeviceGroup, error) {
+	// start instrumentation
+	reply := r.Repo.client.Hvals("users:" + strconv.FormatUint(user.ID, 10) + ":groups")
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return []DeviceGroup{}, reply.Err
+	}
+	if reply.Type == redis.ReplyNil {
+		return []DeviceGroup{}, nil
+	}
+	ids, err := reply.List()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return []DeviceGroup{}, err
+	}
+	groups := []DeviceGroup{}
+	for _, idstr := range ids {
+		id, err := strconv.ParseUint(idstr, 10, 64)
+		if err != nil {
+			r.Log.Error(err.Error())
+			continue
+		}
+		group, err := r.GetDeviceGroup(id)
+		if err == DeviceGroupNotFoundError {
+			continue
+		} else if err != nil {
+			return []DeviceGroup{}, err
+		}
+		groups = append(groups, group)
+	}
+	// stop instrumentation
+	return groups, nil
+}
+
+// GetDeviceGroupMembers returns the group's devices, drawn from its
+// owner's devices so that anything left behind by a device that no longer
+// exists is ignored.
+func (r *RequestBundle) GetDeviceGroupMembers(group DeviceGroup) ([]Device, error) {
+	devices, err := r.GetDevicesByUser(User{ID: group.UserID})
+	if err != nil {
+		return []Device{}, err
+	}
+	members := map[uint64]bool{}
+	for _, id := range group.Devices {
+		members[id] = true
+	}
+	grouped := []Device{}
+	for _, device := range devices {
+		if members[device.ID] {
+			grouped = append(grouped, device)
+		}
+	}
+	return grouped, nil
+}
+
+func (r *RequestBundle) AddDeviceToGroup(group DeviceGroup, device Device) (DeviceGroup, error) {
+	// start instrumentation
+	if device.UserID != group.UserID {
+		return DeviceGroup{}, DeviceGroupOwnerError
+	}
+	for _, member := range group.Devices {
+		if member == device.ID {
+			return group, nil
+		}
+	}
+	reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		mc.Sadd(groupMembersKey(group.ID), device.ID)
+		mc.Sadd("devices:"+strconv.FormatUint(device.ID, 10)+":groups", group.ID)
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return DeviceGroup{}, reply.Err
+	}
+	r.Audit(groupMembersKey(group.ID), strconv.FormatUint(device.ID, 10), "", "1")
+	// add repo call to instrumentation
+	group.Devices = append(group.Devices, device.ID)
+	// stop instrumentation
+	return group, nil
+}
+
+func (r *RequestBundle) RemoveDeviceFromGroup(group DeviceGroup, device Device) (DeviceGroup, error) {
+	// start instrumentation
+	reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		mc.Srem(groupMembersKey(group.ID), device.ID)
+		mc.Srem("devices:"+strconv.FormatUint(device.ID, 10)+":groups", group.ID)
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return DeviceGroup{}, reply.Err
+	}
+	removed, err := reply.Elems[0].Bool()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return DeviceGroup{}, err
+	}
+	if removed {
+		r.Audit(groupMembersKey(group.ID), strconv.FormatUint(device.ID, 10), "1", "")
+		// add repo call to instrumentation
+	}
+	members := []uint64{}
+	for _, member := range group.Devices {
+		if member != device.ID {
+			members = append(members, member)
+		}
+	}
+	group.Devices = members
+	// stop instrumentation
+	return group, nil
+}
+
+func (r *RequestBundle) DeleteDeviceGroup(group DeviceGroup) error {
+	// start instrumentation
+	reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		for _, device := range group.Devices {
+			mc.Srem("devices:"+strconv.FormatUint(device, 10)+":groups", group.ID)
+		}
+		mc.Hdel("users:"+strconv.FormatUint(group.UserID, 10)+":groups", strings.ToLower(group.Name))
+		mc.Del("device_groups:"+strconv.FormatUint(group.ID, 10), groupMembersKey(group.ID))
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return reply.Err
+	}
+	from := map[string]interface{}{
+		"name":    group.Name,
+		"user_id": strconv.FormatUint(group.UserID, 10),
+		"created": group.Created.Format(time.RFC3339),
+	}
+	to := map[string]interface{}{
+		"name":    "",
+		"user_id": "",
+		"created": "",
+	}
+	r.AuditMap("device_groups:"+strconv.FormatUint(group.ID, 10), from, to)
+	// add repo call to instrumentation
+	for _, device := range group.Devices {
+		r.Audit(groupMembersKey(group.ID), strconv.FormatUint(device, 10), "1", "")
+		// add repo call to instrumentation
+	}
+	// stop instrumentation
+	return nil
+}
+
+// AddLinksToGroup sends a copy of the link to every active device in the
+// group except the one sending it, which must belong to the group's owner.
+func (r *RequestBundle) AddLinksToGroup(link Link, group DeviceGroup) ([]Link, error) {
+	if link.Encrypted {
+		return []Link{}, EncryptedGroupLinkError
+	}
+	sender, err := r.GetDevice(link.Sender.ID)
+	if err != nil {
+		return []Link{}, err
+	}
+	if sender.UserID != group.UserID {
+		return []Link{}, DeviceGroupSenderError
+	}
+	devices, err := r.GetDeviceGroupMembers(group)
+	if err != nil {
+		return []Link{}, err
+	}
+	links := []Link{}
+	for _, device := range activeDevices(devices) {
+		if device.ID == link.Sender.ID {
+			continue
+		}
+		copied := link
+		copied.Receiver = device
+		if link.URL != nil {
+			address := *link.URL
+			copied.URL = &address
+		}
+		if link.Payload != nil {
+			payload := *link.Payload
+			copied.Payload = &payload
+		}
+		links = append(links, copied)
+	}
+	if len(links) < 1 {
+		return links, nil
+	}
+	return r.AddLinks(links)
+}
+
+// GroupNotificationError is returned when some of a group's devices
+// couldn't be sent notifications; the rest were still sent them.
+type GroupNotificationError struct {
+	Failed map[uint64]error
+}
+
+func (e *GroupNotificationError) Error() string {
+	return "Notifications couldn't be sent to " + strconv.Itoa(len(e.Failed)) + " of the group's devices."
+}
+
+// SendNotificationsToGroup delivers the notifications to each device in the
+// group as though they had been sent to it directly. A device that can't be
+// sent them doesn't stop the rest: everything that was sent is returned,
+// along with a GroupNotificationError naming the devices that failed.
+func (r *RequestBundle) SendNotificationsToGroup(group DeviceGroup, notifications []Notification) ([]Notification, error) {
+	// start instrumentation
+	devices, err := r.GetDeviceGroupMembers(group)
+	if err != nil {
+		return []Notification{}, err
+	}
+	sent := []Notification{}
+	failed := map[uint64]error{}
+	for _, device := range activeDevices(devices) {
+		stored, err := r.SendNotificationsToDevice(device, copyNotifications(notifications))
+		if err != nil {
+			failed[device.ID] = err
+			continue
+		}
+		sent = append(sent, stored...)
+	}
+	// stop instrumentation
+	if len(failed) > 0 {
+		return sent, &GroupNotificationError{Failed: failed}
+	}
+	return sent, nil
+}
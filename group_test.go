@@ -0,0 +1,117 @@
+package twocloud
+
+import (
+	"testing"
+)
+
+func TestCreateDeviceGroupNamesAreUniquePerUser(t *testing.T) {
+	r, _ := testBundle(t)
+	_, err := r.CreateDeviceGroup(User{ID: 10}, "Phones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.CreateDeviceGroup(User{ID: 10}, " phones ")
+	if err != DeviceGroupNameTakenError {
+		t.Errorf("Expected DeviceGroupNameTakenError, got %v.", err)
+	}
+	_, err = r.CreateDeviceGroup(User{ID: 20}, "Phones")
+	if err != nil {
+		t.Errorf("Expected another user to be able to use the name, got %v.", err)
+	}
+}
+
+func TestAddDeviceToGroupRequiresOwnersDevice(t *testing.T) {
+	r, server := testBundle(t)
+	testDevice(t, r, "2", "20")
+	group, err := r.CreateDeviceGroup(User{ID: 10}, "Phones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, err := r.GetDevice(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.AddDeviceToGroup(group, device)
+	if err != DeviceGroupOwnerError {
+		t.Errorf("Expected DeviceGroupOwnerError, got %v.", err)
+	}
+	assertNoKeys(t, server, groupMembersKey(group.ID), "devices:2:groups")
+}
+
+func TestDeleteDeviceRemovesItFromGroups(t *testing.T) {
+	r, server := testBundle(t)
+	testDevice(t, r, "1", "10")
+	testDevice(t, r, "2", "10")
+	group, err := r.CreateDeviceGroup(User{ID: 10}, "Phones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []uint64{1, 2} {
+		device, err := r.GetDevice(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		group, err = r.AddDeviceToGroup(group, device)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	device, err := r.GetDevice(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.DeleteDevice(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertNoKeys(t, server, "devices:1:groups")
+	member, err := server.SIsMember(groupMembersKey(group.ID), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if member {
+		t.Error("The deleted device was left in the group.")
+	}
+	group, err = r.GetDeviceGroup(group.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(group.Devices) != 1 || group.Devices[0] != 2 {
+		t.Errorf("Expected only device 2 to be left in the group, got %v.", group.Devices)
+	}
+}
+
+func TestSendNotificationsToGroupKeepsGoingPastFailures(t *testing.T) {
+	r, server := testBundle(t)
+	group, err := r.CreateDeviceGroup(User{ID: 10}, "Phones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		testDevice(t, r, id, "10")
+		server.SAdd(groupMembersKey(group.ID), id)
+	}
+	group, err = r.GetDeviceGroup(group.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// looking up the owner's preferences fails for whichever device is sent
+	// to first, and only that one
+	failCommandOnce(server, "HGETALL", "users:10:preferences")
+	sent, err := r.SendNotificationsToGroup(group, []Notification{{Nature: "test", Body: "Hello"}})
+	failed, ok := err.(*GroupNotificationError)
+	if !ok {
+		t.Fatalf("Expected a GroupNotificationError, got %v.", err)
+	}
+	if len(failed.Failed) != 1 {
+		t.Errorf("Expected one device to fail, got %v.", failed.Failed)
+	}
+	if len(sent) != 2 {
+		t.Fatalf("Expected 2 notifications to be sent, got %d.", len(sent))
+	}
+	for _, notification := range sent {
+		if failed.Failed[notification.Destination] != nil {
+			t.Error("A notification was reported sent to the failed device.")
+		}
+	}
+}
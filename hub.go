@@ -0,0 +1,333 @@
+package twocloud
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"encoding/json"
+	"errors"
+	"github.com/fzzbt/radix/redis"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const pushChannelPrefix = "push:"
+const hubSendBuffer = 64
+
+func pushChannel(pusher string, device uint64) string {
+	return pushChannelPrefix + pusher + ":" + strconv.FormatUint(device, 10)
+}
+
+// PushEvent is what real-time transports send to a device when a link or
+// notification arrives for it. Delivery is set when the event belongs to a
+// tracked delivery, so the device can acknowledge it.
+type PushEvent struct {
+	Type         string        `json:"type"`
+	ID           uint64        `json:"id"`
+	Delivery     uint64        `json:"delivery,omitempty"`
+	Link         *Link         `json:"link,omitempty"`
+	Notification *Notification `json:"notification,omitempty"`
+}
+
+type hubMessage struct {
+	Type     string `json:"type"`
+	Delivery uint64 `json:"delivery,omitempty"`
+}
+
+var HubClosedError = errors.New("The push hub has been closed.")
+
+// DeviceAuthenticator identifies the device making a push connection.
+type DeviceAuthenticator func(req *http.Request) (User, Device, error)
+
+type hubConn struct {
+	device  Device
+	channel string
+	send    chan []byte
+	close   func()
+}
+
+// Hub keeps track of the devices connected to this node and relays the push
+// events published for them. Events are published through Redis on a
+// channel per pusher and device, so a device receives them no matter which
+// node it's connected to.
+type Hub struct {
+	base         RequestBundle
+	authenticate DeviceAuthenticator
+	subscription *redis.Subscription
+	conns        map[string]map[*hubConn]bool
+	lock         sync.RWMutex
+	closed       bool
+	// subscribing happens outside lock, so relay is never blocked behind
+	// a connection waiting on Redis
+	subscribed map[string]bool
+	subLock    sync.Mutex
+}
+
+func NewHub(base RequestBundle, authenticate DeviceAuthenticator) (*Hub, error) {
+	hub := &Hub{
+		base:         base,
+		authenticate: authenticate,
+		conns:        map[string]map[*hubConn]bool{},
+		subscribed:   map[string]bool{},
+	}
+	subscription, err := base.Repo.client.Subscription(hub.relay)
+	if err != nil {
+		return nil, err
+	}
+	hub.subscription = subscription
+	return hub, nil
+}
+
+func (h *Hub) Close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		return
+	}
+	h.closed = true
+	for _, conns := range h.conns {
+		for conn, _ := range conns {
+			close(conn.send)
+		}
+	}
+	h.conns = map[string]map[*hubConn]bool{}
+	h.subscription.Close()
+}
+
+func (h *Hub) Handler() http.Handler {
+	return websocket.Handler(h.serve)
+}
+
+// Connected reports whether a device has a connection open to this node
+// through the pusher.
+func (h *Hub) Connected(pusher string, device uint64) bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return len(h.conns[pushChannel(pusher, device)]) > 0
+}
+
+func (h *Hub) bundle(req *http.Request, user User, device Device) *RequestBundle {
+	bundle := h.base
+	bundle.Request = req
+	bundle.AuthUser = user
+	bundle.Device = device
+	return &bundle
+}
+
+func (h *Hub) serve(ws *websocket.Conn) {
+	defer ws.Close()
+	user, device, err := h.authenticate(ws.Request())
+	if err != nil {
+		websocket.JSON.Send(ws, map[string]string{"error": err.Error()})
+		return
+	}
+	conn := &hubConn{
+		device:  device,
+		channel: pushChannel(PusherWebSockets, device.ID),
+		send:    make(chan []byte, hubSendBuffer),
+		close: func() {
+			ws.Close()
+		},
+	}
+	err = h.register(conn)
+	if err != nil {
+		h.base.Log.Error(err.Error())
+		return
+	}
+	defer h.unregister(conn)
+	r := h.bundle(ws.Request(), user, device)
+	err = r.UpdateDeviceWebSocketLastUsed(device)
+	if err != nil {
+		r.Log.Error(err.Error())
+	}
+	stop := make(chan bool)
+	defer close(stop)
+	go r.heartbeatPresence(device, stop)
+	go conn.write(ws)
+	r.replayQueuedDeliveries(device, PusherWebSockets, nil)
+	for {
+		var message hubMessage
+		err = websocket.JSON.Receive(ws, &message)
+		if err != nil {
+			return
+		}
+		if message.Type != "ack" || message.Delivery == 0 {
+			continue
+		}
+		err = r.acknowledgeDelivery(device, message.Delivery)
+		if err != nil {
+			r.Log.Error(err.Error())
+		}
+	}
+}
+
+func (c *hubConn) write(ws *websocket.Conn) {
+	for event := range c.send {
+		_, err := ws.Write(event)
+		if err != nil {
+			ws.Close()
+			return
+		}
+	}
+}
+
+func (h *Hub) register(conn *hubConn) error {
+	h.lock.Lock()
+	if h.closed {
+		h.lock.Unlock()
+		return HubClosedError
+	}
+	if _, exists := h.conns[conn.channel]; !exists {
+		h.conns[conn.channel] = map[*hubConn]bool{}
+	}
+	h.conns[conn.channel][conn] = true
+	h.lock.Unlock()
+	return h.syncSubscription(conn.channel)
+}
+
+func (h *Hub) unregister(conn *hubConn) {
+	h.lock.Lock()
+	conns, exists := h.conns[conn.channel]
+	if !exists || !conns[conn] {
+		h.lock.Unlock()
+		return
+	}
+	delete(conns, conn)
+	close(conn.send)
+	if len(conns) < 1 {
+		delete(h.conns, conn.channel)
+	}
+	h.lock.Unlock()
+	err := h.syncSubscription(conn.channel)
+	if err != nil {
+		h.base.Log.Error(err.Error())
+	}
+}
+
+// syncSubscription subscribes to a channel while it has connections to
+// this node and unsubscribes once it has none.
+func (h *Hub) syncSubscription(channel string) error {
+	h.subLock.Lock()
+	defer h.subLock.Unlock()
+	h.lock.RLock()
+	wanted := len(h.conns[channel]) > 0 && !h.closed
+	h.lock.RUnlock()
+	if wanted && !h.subscribed[channel] {
+		err := h.subscription.Subscribe(channel)
+		if err != nil {
+			return err
+		}
+		h.subscribed[channel] = true
+	} else if !wanted && h.subscribed[channel] {
+		err := h.subscription.Unsubscribe(channel)
+		if err != nil {
+			return err
+		}
+		delete(h.subscribed, channel)
+	}
+	return nil
+}
+
+// relay hands an event published on a channel to each of its connections.
+// A connection that has fallen too far behind is dropped rather than
+// holding up everyone else.
+func (h *Hub) relay(message *redis.Message) {
+	if message.Type != redis.MessageMessage || !strings.HasPrefix(message.Channel, pushChannelPrefix) {
+		return
+	}
+	h.lock.RLock()
+	stalled := []*hubConn{}
+	for conn, _ := range h.conns[message.Channel] {
+		select {
+		case conn.send <- []byte(message.Payload):
+		default:
+			stalled = append(stalled, conn)
+		}
+	}
+	h.lock.RUnlock()
+	for _, conn := range stalled {
+		h.unregister(conn)
+		conn.close()
+	}
+}
+
+// publishPushEvent sends an event to every node holding a connection for
+// the device through the pusher, returning how many nodes received it.
+func (r *RequestBundle) publishPushEvent(pusher string, device uint64, event PushEvent) (int64, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return 0, err
+	}
+	reply := r.Repo.client.Publish(pushChannel(pusher, device), string(payload))
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return 0, reply.Err
+	}
+	receivers, err := reply.Int64()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return 0, err
+	}
+	return receivers, nil
+}
+
+func (r *RequestBundle) acknowledgeDelivery(device Device, id uint64) error {
+	delivery, err := r.GetDelivery(id)
+	if err != nil {
+		return err
+	}
+	if delivery.Device != device.ID {
+		return DeliveryNotFoundError
+	}
+	_, err = r.UpdateDeliveryStatus(delivery, DeliveryAcked, "")
+	return err
+}
+
+// replayQueuedDeliveries republishes the notifications that were queued for
+// a pusher while the device wasn't connected. Deliveries of notifications in
+// sent, which the device has already been given some other way, are just
+// marked sent.
+func (r *RequestBundle) replayQueuedDeliveries(device Device, pusher string, sent map[uint64]bool) {
+	deliveries, err := r.GetDeliveriesByDevice(device, 0, 0, 0)
+	if err != nil {
+		return
+	}
+	for pos := len(deliveries) - 1; pos >= 0; pos-- {
+		delivery := deliveries[pos]
+		if delivery.Pusher != pusher || delivery.Status != DeliveryQueued {
+			continue
+		}
+		if sent[delivery.Notification] {
+			_, err = r.UpdateDeliveryStatus(delivery, DeliverySent, "")
+			if err != nil {
+				r.Log.Error(err.Error())
+			}
+			continue
+		}
+		notification, err := r.GetNotification(delivery.Notification)
+		if err != nil {
+			continue
+		}
+		if notification.IsExpired() {
+			_, err = r.UpdateDeliveryStatus(delivery, DeliveryFailed, "The notification expired before it could be delivered.")
+			if err != nil {
+				r.Log.Error(err.Error())
+			}
+			continue
+		}
+		receivers, err := r.publishPushEvent(pusher, device.ID, r.localizeEvent(device, PushEvent{
+			Type:         "notification",
+			ID:           notification.ID,
+			Delivery:     delivery.ID,
+			Notification: &notification,
+		}))
+		if err != nil || receivers < 1 {
+			continue
+		}
+		_, err = r.UpdateDeliveryStatus(delivery, DeliverySent, "")
+		if err != nil {
+			r.Log.Error(err.Error())
+		}
+	}
+}
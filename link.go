@@ -1,9 +1,12 @@
 package twocloud
 
 import (
+	"encoding/json"
+	"errors"
 	"github.com/PuerkitoBio/purell"
 	"github.com/fzzbt/radix/redis"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -12,17 +15,68 @@ type URL struct {
 	FirstSeen   time.Time `json:"first_seen,omitempty"`
 	SentCounter int64     `json:"sent_counter,omitempty"`
 	Address     string    `json:"address,omitempty"`
+	Verdict     Verdict   `json:"verdict,omitempty"`
+	Screened    time.Time `json:"screened,omitempty"`
 }
 
+type PayloadKind string
+
+const (
+	PayloadURL     = PayloadKind("url")
+	PayloadText    = PayloadKind("text")
+	PayloadNote    = PayloadKind("note")
+	PayloadPhone   = PayloadKind("phone")
+	PayloadAddress = PayloadKind("address")
+	PayloadFile    = PayloadKind("file")
+)
+
+var validPayloadKinds = []PayloadKind{PayloadURL, PayloadText, PayloadNote, PayloadPhone, PayloadAddress, PayloadFile}
+
+func (k PayloadKind) IsValid() bool {
+	for _, kind := range validPayloadKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+type Payload struct {
+	Text        string `json:"text,omitempty"`
+	FileName    string `json:"file_name,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	Blob        string `json:"blob,omitempty"`
+	Data        []byte `json:"data,omitempty"`
+}
+
+var InvalidPayloadKindError = errors.New("Invalid payload kind.")
+var MissingPayloadError = errors.New("No payload was supplied for the link.")
+var PayloadTooLargeError = errors.New("The file is too large to send.")
+var NoBlobStoreError = errors.New("File payloads are not supported on this server.")
+var LinkNotFoundError = errors.New("Link not found.")
+var URLNotFoundError = errors.New("URL not found.")
+var UnexpectedReplyError = errors.New("Unexpected reply from the database.")
+var PlaintextInEncryptedLinkError = errors.New("Encrypted links may only carry ciphertext.")
+var NoReceiverKeyError = errors.New("The receiving device has not registered an encryption key.")
+var StaleReceiverKeyError = errors.New("The link was encrypted with an outdated key for the receiving device.")
+var CannotReceiveFilesError = errors.New("The receiving device can't accept files.")
+
 type Link struct {
-	ID       uint64    `json:"id,omitempty"`
-	URL      *URL      `json:"url,omitempty"`
-	Unread   bool      `json:"unread,omitempty"`
-	TimeRead time.Time `json:"time_read,omitempty"`
-	Sender   Device    `json:"sender,omitempty"`
-	Receiver Device    `json:"receiver,omitempty"`
-	Comment  string    `json:"comment,omitempty"`
-	Sent     time.Time `json:"sent,omitempty"`
+	ID         uint64      `json:"id,omitempty"`
+	Kind       PayloadKind `json:"kind,omitempty"`
+	URL        *URL        `json:"url,omitempty"`
+	Payload    *Payload    `json:"payload,omitempty"`
+	Unread     bool        `json:"unread,omitempty"`
+	TimeRead   time.Time   `json:"time_read,omitempty"`
+	Sender     Device      `json:"sender,omitempty"`
+	Receiver   Device      `json:"receiver,omitempty"`
+	Comment    string      `json:"comment,omitempty"`
+	Sent       time.Time   `json:"sent,omitempty"`
+	Encrypted  bool        `json:"encrypted,omitempty"`
+	Ciphertext string      `json:"ciphertext,omitempty"`
+	KeyPrint   string      `json:"key_fingerprint,omitempty"`
+	Warning    Verdict     `json:"warning,omitempty"`
 }
 
 type RoleFlag int
@@ -41,101 +95,244 @@ func (r *RequestBundle) GetLinksByUser(user User, role RoleFlag, before, after u
 	return []Link{}, nil
 }
 
+func (r *RequestBundle) getLinksByKey(key string, before, after uint64, count int) ([]Link, error) {
+	// start instrumentation
+	reply := r.Repo.client.Lrange(key, 0, -1)
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return []Link{}, reply.Err
+	}
+	if reply.Type == redis.ReplyNil {
+		return []Link{}, nil
+	}
+	ids, err := reply.List()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return []Link{}, err
+	}
+	ids = pageIDs(ids, before, after, count)
+	reply = r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		for _, id := range ids {
+			mc.Hgetall("links:" + id)
+		}
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return []Link{}, reply.Err
+	}
+	links := []Link{}
+	for pos, elem := range reply.Elems {
+		if elem.Type == redis.ReplyNil {
+			continue
+		}
+		hash, err := elem.Hash()
+		if err != nil {
+			r.Log.Error(err.Error())
+			continue
+		}
+		id, err := strconv.ParseUint(ids[pos], 10, 64)
+		if err != nil {
+			r.Log.Error(err.Error())
+			continue
+		}
+		link, err := r.linkFromHash(id, hash)
+		if err != nil {
+			r.Log.Error(err.Error())
+			continue
+		}
+		links = append(links, link)
+	}
+	// stop instrumentation
+	return links, nil
+}
+
 func (r *RequestBundle) GetLink(id uint64) (Link, error) {
-	return Link{}, nil
+	// start instrumentation
+	reply := r.Repo.client.Hgetall("links:" + strconv.FormatUint(id, 10))
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return Link{}, reply.Err
+	}
+	if reply.Type == redis.ReplyNil {
+		return Link{}, LinkNotFoundError
+	}
+	hash, err := reply.Hash()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return Link{}, err
+	}
+	link, err := r.linkFromHash(id, hash)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return Link{}, err
+	}
+	// stop instrumentation
+	return link, nil
+}
+
+func (r *RequestBundle) linkFromHash(id uint64, hash map[string]string) (Link, error) {
+	sent, err := time.Parse(time.RFC3339, hash["sent"])
+	if err != nil {
+		return Link{}, err
+	}
+	time_read, err := time.Parse(time.RFC3339, hash["time_read"])
+	if err != nil {
+		return Link{}, err
+	}
+	sender_id, err := strconv.ParseUint(hash["sender"], 10, 64)
+	if err != nil {
+		return Link{}, err
+	}
+	receiver_id, err := strconv.ParseUint(hash["receiver"], 10, 64)
+	if err != nil {
+		return Link{}, err
+	}
+	link := Link{
+		ID:       id,
+		Kind:     PayloadKind(hash["kind"]),
+		Unread:   hash["unread"] == "1",
+		TimeRead: time_read,
+		Comment:  hash["comment"],
+		Sent:     sent,
+	}
+	if link.Kind == "" {
+		link.Kind = PayloadURL
+	}
+	if hash["warning"] != "" {
+		link.Warning = Verdict(hash["warning"])
+	}
+	if hash["encrypted"] == "1" {
+		link.Encrypted = true
+		link.Ciphertext = hash["ciphertext"]
+		link.KeyPrint = hash["key_fingerprint"]
+	}
+	link.Sender, err = r.GetDevice(sender_id)
+	if err == DeviceNotFoundError {
+		link.Sender = Device{ID: sender_id}
+	} else if err != nil {
+		return Link{}, err
+	}
+	link.Receiver, err = r.GetDevice(receiver_id)
+	if err == DeviceNotFoundError {
+		link.Receiver = Device{ID: receiver_id}
+	} else if err != nil {
+		return Link{}, err
+	}
+	if link.Kind == PayloadURL && !link.Encrypted {
+		url_id, err := strconv.ParseUint(hash["url"], 10, 64)
+		if err != nil {
+			return Link{}, err
+		}
+		link.URL, err = r.getURL(url_id)
+		if err != nil {
+			return Link{}, err
+		}
+		return link, nil
+	}
+	size, err := strconv.ParseInt(hash["size"], 10, 64)
+	if err != nil {
+		size = 0
+	}
+	link.Payload = &Payload{
+		Text:        hash["text"],
+		FileName:    hash["file_name"],
+		ContentType: hash["content_type"],
+		Size:        size,
+		Blob:        hash["blob"],
+	}
+	return link, nil
 }
 
 func (r *RequestBundle) AddLinks(links []Link) ([]Link, error) {
-	urls := []*URL{}
-	url_counts := map[uint64]int{}
-	reservedAddress := []string{}
+	err := r.checkReceiversActive(links)
+	if err != nil {
+		return []Link{}, err
+	}
+	storedBlobs := []string{}
+	flagged := []int{}
+	assigned := map[int]uint64{}
 	for pos, link := range links {
-		id, err := r.GetID()
-		if err != nil {
-			r.Log.Error(err.Error())
-			for _, a := range reservedAddress {
-				newErr := r.releaseAddress(a)
-				if newErr != nil {
-					r.Log.Error(newErr.Error())
-				}
-			}
-			return []Link{}, err
+		if link.Kind == "" {
+			link.Kind = PayloadURL
+			links[pos].Kind = PayloadURL
 		}
-		success, err := r.reserveAddress(link.URL.Address, id)
+		err := r.validatePayload(link)
 		if err != nil {
-			r.Log.Error(err.Error())
-			for _, a := range reservedAddress {
-				newErr := r.releaseAddress(a)
-				if newErr != nil {
-					r.Log.Error(newErr.Error())
-				}
-			}
+			r.releasePayloadData(storedBlobs)
 			return []Link{}, err
 		}
-		link.URL.ID = id
-		if success {
-			reservedAddress = append(reservedAddress, link.URL.Address)
-			urls = append(urls, link.URL)
-			link.URL.FirstSeen = time.Now()
-		} else {
-			newID, err := r.getIDFromAddress(link.URL.Address)
+		if link.URL != nil && r.Screener != nil {
+			verdict, err := r.screenURL(link.URL)
 			if err != nil {
-				r.Log.Error(err.Error())
-				for _, a := range reservedAddress {
-					newErr := r.releaseAddress(a)
-					if newErr != nil {
-						r.Log.Error(newErr.Error())
-					}
-				}
+				r.releasePayloadData(storedBlobs)
 				return []Link{}, err
 			}
-			link.URL.ID = newID
+			switch r.screeningAction(verdict) {
+			case ScreeningBlock:
+				r.Log.Warn("Blocked %s link to %s from device %d.", verdict, link.URL.Address, link.Sender.ID)
+				r.releasePayloadData(storedBlobs)
+				return []Link{}, &URLBlockedError{Address: link.URL.Address, Verdict: verdict}
+			case ScreeningWarn:
+				links[pos].Warning = verdict
+			case ScreeningFlag:
+				flagged = append(flagged, pos)
+			}
 		}
-		url_counts[link.URL.ID] = url_counts[link.URL.ID] + 1
 		linkID, err := r.GetID()
 		if err != nil {
 			r.Log.Error(err.Error())
-			for _, a := range reservedAddress {
-				newErr := r.releaseAddress(a)
-				if newErr != nil {
-					r.Log.Error(newErr.Error())
-				}
-			}
+			r.releasePayloadData(storedBlobs)
 			return []Link{}, err
 		}
 		links[pos].ID = linkID
+		assigned[pos] = linkID
 		links[pos].Sent = time.Now()
-	}
-	err := r.storeURLs(urls)
-	if err != nil {
-		r.Log.Error(err.Error())
-		for _, a := range reservedAddress {
-			newErr := r.releaseAddress(a)
-			if newErr != nil {
-				r.Log.Error(newErr.Error())
+		if link.URL != nil {
+			// only used if the address has never been seen before
+			link.URL.ID, err = r.GetID()
+			if err != nil {
+				r.Log.Error(err.Error())
+				r.releasePayloadData(storedBlobs)
+				return []Link{}, err
 			}
 		}
-		return []Link{}, err
+		if link.Kind == PayloadFile {
+			err = r.storePayloadData(links[pos])
+			if err != nil {
+				r.Log.Error(err.Error())
+				r.releasePayloadData(storedBlobs)
+				return []Link{}, err
+			}
+			storedBlobs = append(storedBlobs, link.Payload.Blob)
+		}
 	}
 	err = r.storeLinks(links, false)
 	if err != nil {
 		r.Log.Error(err.Error())
-		for _, a := range reservedAddress {
-			newErr := r.releaseAddress(a)
-			if newErr != nil {
-				r.Log.Error(newErr.Error())
-			}
-		}
+		r.releasePayloadData(storedBlobs)
 		return []Link{}, err
 	}
-	for url_id, count := range url_counts {
-		r.Log.Debug("Incrementing %s by %d", url_id, count)
-		err := r.incrementURL(url_id, count)
+	if len(flagged) > 0 {
+		flaggedLinks := []Link{}
+		for _, pos := range flagged {
+			flaggedLinks = append(flaggedLinks, links[pos])
+		}
+		err = r.flagLinks(flaggedLinks)
 		if err != nil {
 			r.Log.Error(err.Error())
-			r.Log.Error("Error incrementing %s by %d", url_id, count)
 		}
 	}
+	// duplicates come back as the link already sent, which was pushed then
+	stored := []Link{}
+	for pos, link := range links {
+		if link.ID == assigned[pos] {
+			stored = append(stored, link)
+		}
+	}
+	r.pushLinks(stored)
 	return links, nil
 }
 
@@ -157,50 +354,154 @@ func (r *RequestBundle) AddLink(address, comment string, sender, receiver Device
 	return resp[0], nil
 }
 
-func (r *RequestBundle) storeURLs(urls []*URL) error {
-	auditlog := map[uint64]map[string]interface{}{}
-	reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
-		for _, url := range urls {
-			if url == nil {
-				continue
-			}
-			changes := map[string]interface{}{
-				"first_seen":   url.FirstSeen.Format(time.RFC3339),
-				"sent_counter": 0,
-				"address":      url.Address,
-			}
-			mc.Hmset("urls:"+strconv.FormatUint(url.ID, 10), changes)
-			auditlog[url.ID] = changes
+func (r *RequestBundle) AddPayload(kind PayloadKind, payload Payload, comment string, sender, receiver Device, unread bool) (Link, error) {
+	link := Link{
+		Kind:     kind,
+		Payload:  &payload,
+		Unread:   unread,
+		Sender:   sender,
+		Receiver: receiver,
+		Comment:  comment,
+	}
+	resp, err := r.AddLinks([]Link{link})
+	if err != nil {
+		r.Log.Error(err.Error())
+		return Link{}, err
+	}
+	return resp[0], nil
+}
+
+func (r *RequestBundle) validatePayload(link Link) error {
+	if !link.Kind.IsValid() {
+		return InvalidPayloadKindError
+	}
+	if link.Kind == PayloadFile {
+		receiver, err := r.GetDevice(link.Receiver.ID)
+		if err != nil {
+			return err
+		}
+		if !r.deviceCan(receiver, CapabilityReceiveFiles) {
+			return CannotReceiveFilesError
 		}
-	})
-	// add repo call to instrumentation
-	if reply.Err != nil {
-		r.Log.Error(reply.Err.Error())
-		return reply.Err
 	}
-	from := map[string]interface{}{
-		"first_seen":   "",
-		"sent_counter": "",
-		"address":      "",
+	if link.Encrypted {
+		return r.validateEncryptedPayload(link)
 	}
-	for id, audit := range auditlog {
-		r.AuditMap("urls:"+strconv.FormatUint(id, 10), audit, from)
+	if link.Kind == PayloadURL {
+		if link.URL == nil || link.URL.Address == "" {
+			return MissingPayloadError
+		}
+		return nil
 	}
-	// add repo calls to instrumentation
+	if link.Payload == nil {
+		return MissingPayloadError
+	}
+	if link.Kind != PayloadFile {
+		if link.Payload.Text == "" {
+			return MissingPayloadError
+		}
+		return nil
+	}
+	if len(link.Payload.Data) < 1 {
+		return MissingPayloadError
+	}
+	if r.Blobs == nil {
+		return NoBlobStoreError
+	}
+	if r.Config.MaxFileSize > 0 && int64(len(link.Payload.Data)) > r.Config.MaxFileSize {
+		return PayloadTooLargeError
+	}
+	return nil
+}
+
+func (r *RequestBundle) validateEncryptedPayload(link Link) error {
+	if link.Ciphertext == "" {
+		return MissingPayloadError
+	}
+	if link.URL != nil || link.Comment != "" {
+		return PlaintextInEncryptedLinkError
+	}
+	if link.Payload != nil && (link.Payload.Text != "" || link.Payload.FileName != "" || link.Payload.ContentType != "") {
+		return PlaintextInEncryptedLinkError
+	}
+	// the caller's copy of the receiver may be stale or made up, so check
+	// the key it has registered now
+	receiver, err := r.GetDevice(link.Receiver.ID)
+	if err != nil {
+		return err
+	}
+	if receiver.PublicKey == "" {
+		return NoReceiverKeyError
+	}
+	if link.KeyPrint != receiver.KeyPrint {
+		return StaleReceiverKeyError
+	}
+	if link.Kind != PayloadFile {
+		return nil
+	}
+	if link.Payload == nil || len(link.Payload.Data) < 1 {
+		return MissingPayloadError
+	}
+	if r.Blobs == nil {
+		return NoBlobStoreError
+	}
+	if r.Config.MaxFileSize > 0 && int64(len(link.Payload.Data)) > r.Config.MaxFileSize {
+		return PayloadTooLargeError
+	}
+	return nil
+}
+
+func (r *RequestBundle) storePayloadData(link Link) error {
+	// start instrumentation
+	link.Payload.Blob = "links-" + strconv.FormatUint(link.ID, 10)
+	link.Payload.Size = int64(len(link.Payload.Data))
+	err := r.Blobs.Put(link.Payload.Blob, link.Payload.Data)
+	// add blob call to instrumentation
+	if err != nil {
+		link.Payload.Blob = ""
+		return err
+	}
+	link.Payload.Data = nil
 	// stop instrumentation
 	return nil
 }
 
+func (r *RequestBundle) releasePayloadData(blobs []string) {
+	for _, blob := range blobs {
+		err := r.Blobs.Delete(blob)
+		if err != nil {
+			r.Log.Error(err.Error())
+		}
+	}
+}
+
+func (r *RequestBundle) GetPayloadData(link Link) ([]byte, error) {
+	// start instrumentation
+	if link.Kind != PayloadFile || link.Payload == nil || link.Payload.Blob == "" {
+		return []byte{}, MissingPayloadError
+	}
+	if r.Blobs == nil {
+		return []byte{}, NoBlobStoreError
+	}
+	data, err := r.Blobs.Get(link.Payload.Blob)
+	// add blob call to instrumentation
+	if err != nil {
+		r.Log.Error(err.Error())
+		return []byte{}, err
+	}
+	// stop instrumentation
+	return data, nil
+}
+
 func (r *RequestBundle) storeLinks(links []Link, update bool) error {
 	// start instrumentation
 	if update {
 		changes := map[uint64]map[string]interface{}{}
 		from := map[uint64]map[string]interface{}{}
-		linksFromID := map[uint64]Link{}
+		receivers := map[uint64]string{}
 		reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
 			for _, link := range links {
 				mc.Hgetall("links:" + strconv.FormatUint(link.ID, 10))
-				linksFromID[link.ID] = link
 			}
 		})
 		// add repo call to instrumentation
@@ -226,6 +527,9 @@ func (r *RequestBundle) storeLinks(links []Link, update bool) error {
 				r.Log.Error(err.Error())
 				continue
 			}
+			changes[link.ID] = map[string]interface{}{}
+			from[link.ID] = map[string]interface{}{}
+			receivers[link.ID] = hash["receiver"]
 			if link.Unread != (hash["unread"] == "1") {
 				changes[link.ID]["unread"] = link.Unread
 				from[link.ID]["unread"] = hash["unread"] == "1"
@@ -233,16 +537,29 @@ func (r *RequestBundle) storeLinks(links []Link, update bool) error {
 				from[link.ID]["time_read"] = time_read.Format(time.RFC3339)
 			}
 			if link.Comment != hash["comment"] {
+				if hash["encrypted"] == "1" && link.Comment != "" {
+					return PlaintextInEncryptedLinkError
+				}
 				changes[link.ID]["comment"] = link.Comment
 				from[link.ID]["comment"] = hash["comment"]
 			}
 		}
+		ids := []uint64{}
 		reply = r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
 			for id, values := range changes {
-				mc.Hmset("links:"+strconv.FormatUint(id, 10), values)
-				if unread, set := values["unread"]; set && !unread.(bool) {
-					mc.Lrem("devices:"+strconv.FormatUint(linksFromID[id].Receiver.ID, 10)+":links:unread", 0, id)
+				if len(values) < 1 {
+					continue
+				}
+				setComment, comment := "0", ""
+				if value, set := values["comment"]; set {
+					setComment, comment = "1", value.(string)
 				}
+				unread, timeRead := "", ""
+				if value, set := values["unread"]; set {
+					unread, timeRead = boolString(value.(bool)), values["time_read"].(string)
+				}
+				mc.Eval(updateLinkScript, 0, id, receivers[id], setComment, comment, unread, timeRead)
+				ids = append(ids, id)
 			}
 		})
 		// add repo call to instrumentation
@@ -250,200 +567,392 @@ func (r *RequestBundle) storeLinks(links []Link, update bool) error {
 			r.Log.Error(reply.Err.Error())
 			return reply.Err
 		}
-		for id, _ := range changes {
+		var failed error
+		for pos, id := range ids {
+			if pos < len(reply.Elems) && reply.Elems[pos].Err != nil {
+				r.Log.Error(reply.Elems[pos].Err.Error())
+				failed = reply.Elems[pos].Err
+				continue
+			}
 			r.AuditMap("links:"+strconv.FormatUint(id, 10), from[id], changes[id])
 		}
 		// add repo calls to instrumentation
-		return nil
+		return failed
 	}
 	changes := map[uint64]map[string]interface{}{}
-	senders := map[uint64][]uint64{}
-	receivers := map[uint64][]uint64{}
-	unread := map[uint64][]uint64{}
-	deviceIDs := map[uint64]uint64{}
-	requestOrder := []uint64{}
-	reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
-		for _, link := range links {
-			values := map[string]interface{}{
-				"unread":    link.Unread,
-				"time_read": link.TimeRead.Format(time.RFC3339),
-				"sender":    link.Sender.ID,
-				"receiver":  link.Receiver.ID,
-				"comment":   link.Comment,
-				"sent":      link.Sent.Format(time.RFC3339),
-			}
-			if link.URL != nil {
-				values["url"] = link.URL.ID
+	batch := linkBatch{
+		Now:    time.Now().Format(time.RFC3339),
+		Window: int64(r.Config.DuplicateWindow),
+		Links:  []linkBatchItem{},
+	}
+	for _, link := range links {
+		values := map[string]interface{}{
+			"unread":    boolString(link.Unread),
+			"time_read": link.TimeRead.Format(time.RFC3339),
+			"sender":    strconv.FormatUint(link.Sender.ID, 10),
+			"receiver":  strconv.FormatUint(link.Receiver.ID, 10),
+			"comment":   link.Comment,
+			"sent":      link.Sent.Format(time.RFC3339),
+			"kind":      string(link.Kind),
+		}
+		if link.Warning != "" {
+			values["warning"] = string(link.Warning)
+		}
+		if link.Encrypted {
+			values["encrypted"] = boolString(true)
+			values["ciphertext"] = link.Ciphertext
+			values["key_fingerprint"] = link.KeyPrint
+		}
+		if link.Payload != nil {
+			values["text"] = link.Payload.Text
+			values["file_name"] = link.Payload.FileName
+			values["content_type"] = link.Payload.ContentType
+			values["size"] = strconv.FormatInt(link.Payload.Size, 10)
+			values["blob"] = link.Payload.Blob
+		}
+		item := linkBatchItem{
+			ID:       strconv.FormatUint(link.ID, 10),
+			Sender:   strconv.FormatUint(link.Sender.ID, 10),
+			Receiver: strconv.FormatUint(link.Receiver.ID, 10),
+			Unread:   link.Unread,
+			Fields:   []string{},
+		}
+		if link.URL != nil {
+			normalized, err := purell.NormalizeURLString(link.URL.Address, purell.FlagsSafe)
+			if err != nil {
+				r.Log.Error(err.Error())
+				return err
 			}
-			changes[link.ID] = values
-			mc.Hmset("links:"+strconv.FormatUint(link.ID, 10), values)
-			senders[link.Sender.ID] = append(senders[link.Sender.ID], link.ID)
-			receivers[link.Receiver.ID] = append(receivers[link.Receiver.ID], link.ID)
-			if link.Unread {
-				unread[link.Receiver.ID] = append(unread[link.Receiver.ID], link.ID)
+			item.Address = link.URL.Address
+			item.Normalized = normalized
+			item.URLID = strconv.FormatUint(link.URL.ID, 10)
+			if link.URL.Verdict != "" {
+				item.Verdict = string(link.URL.Verdict)
+				item.Screened = link.URL.Screened.Format(time.RFC3339)
 			}
-			deviceIDs[link.Sender.ID] = 0
-			deviceIDs[link.Receiver.ID] = 0
 		}
-	})
-	// add repo call to instrumentation
-	if reply.Err != nil {
-		r.Log.Error(reply.Err.Error())
-		return reply.Err
-	}
-	reply = r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
-		for id, _ := range deviceIDs {
-			mc.Hget("devices:"+strconv.FormatUint(id, 10), "user_id")
-			requestOrder = append(requestOrder, id)
+		for field, value := range values {
+			item.Fields = append(item.Fields, field, value.(string))
 		}
-	})
+		changes[link.ID] = values
+		batch.Links = append(batch.Links, item)
+	}
+	encoded, err := json.Marshal(batch)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return err
+	}
+	reply := r.Repo.client.Eval(addLinksScript, 0, string(encoded))
 	// add repo call to instrumentation
 	if reply.Err != nil {
 		r.Log.Error(reply.Err.Error())
 		return reply.Err
 	}
-	for pos, el := range reply.Elems {
-		user_id_str, err := el.Str()
-		if err != nil {
-			r.Log.Error(err.Error())
+	if len(reply.Elems) != len(links) {
+		return UnexpectedReplyError
+	}
+	newURLs := map[uint64]*URL{}
+	for pos, elem := range reply.Elems {
+		result, err := elem.List()
+		if err != nil || len(result) != 3 {
+			r.Log.Error("Unexpected reply storing link %d.", links[pos].ID)
 			continue
 		}
-		user_id, err := strconv.ParseUint(user_id_str, 10, 64)
+		linkID, err := strconv.ParseUint(result[1], 10, 64)
 		if err != nil {
 			r.Log.Error(err.Error())
 			continue
 		}
-		deviceIDs[requestOrder[pos]] = user_id
-	}
-	reply = r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
-		for deviceID, linkIDs := range senders {
-			mc.Lpush("devices:"+strconv.FormatUint(deviceID, 10)+":links:sent", linkIDs)
-			mc.Lpush("users:"+strconv.FormatUint(deviceIDs[deviceID], 10)+":links:sent", linkIDs)
+		if result[0] == "duplicate" {
+			delete(changes, links[pos].ID)
+			existing, err := r.GetLink(linkID)
+			if err != nil {
+				r.Log.Error(err.Error())
+				links[pos].ID = linkID
+				continue
+			}
+			links[pos] = existing
+			continue
 		}
-		for deviceID, linkIDs := range unread {
-			mc.Lpush("devices:"+strconv.FormatUint(deviceID, 10)+":links:unread", linkIDs)
-			mc.Lpush("users:"+strconv.FormatUint(deviceIDs[deviceID], 10)+":links:unread", linkIDs)
+		if links[pos].URL == nil {
+			continue
 		}
-		for deviceID, linkIDs := range receivers {
-			mc.Lpush("devices:"+strconv.FormatUint(deviceID, 10)+":links:received", linkIDs)
-			mc.Lpush("users:"+strconv.FormatUint(deviceIDs[deviceID], 10)+":links:received", linkIDs)
+		urlID, err := strconv.ParseUint(result[2], 10, 64)
+		if err != nil {
+			r.Log.Error(err.Error())
+			continue
 		}
-	})
-	// add repo call to instrumentation
-	if reply.Err != nil {
-		r.Log.Error(reply.Err.Error())
-		return reply.Err
+		changes[links[pos].ID]["url"] = result[2]
+		if result[0] == "new_url" {
+			links[pos].URL.FirstSeen = time.Now()
+			newURLs[urlID] = links[pos].URL
+		}
+		links[pos].URL.ID = urlID
 	}
 	from := map[string]interface{}{
-		"unread":    "",
-		"time_read": "",
-		"sender":    "",
-		"receiver":  "",
-		"comment":   "",
-		"sent":      "",
-		"url":       "",
+		"unread":          "",
+		"time_read":       "",
+		"sender":          "",
+		"receiver":        "",
+		"comment":         "",
+		"sent":            "",
+		"url":             "",
+		"kind":            "",
+		"text":            "",
+		"file_name":       "",
+		"content_type":    "",
+		"size":            "",
+		"blob":            "",
+		"encrypted":       "",
+		"ciphertext":      "",
+		"key_fingerprint": "",
+		"warning":         "",
 	}
 	for id, _ := range changes {
 		r.AuditMap("links:"+strconv.FormatUint(id, 10), from, changes[id])
 	}
+	url_from := map[string]interface{}{
+		"first_seen":   "",
+		"sent_counter": "",
+		"address":      "",
+	}
+	for id, url := range newURLs {
+		normalized, err := purell.NormalizeURLString(url.Address, purell.FlagsSafe)
+		if err != nil {
+			normalized = url.Address
+		}
+		r.Audit("urls_to_ids", normalized, "", strconv.FormatUint(id, 10))
+		r.AuditMap("urls:"+strconv.FormatUint(id, 10), url_from, map[string]interface{}{
+			"first_seen":   batch.Now,
+			"sent_counter": 0,
+			"address":      url.Address,
+		})
+	}
 	// add repo calls to instrumentation
 	return nil
 }
 
-func (r *RequestBundle) getIDFromAddress(address string) (uint64, error) {
+type linkBatch struct {
+	Now    string          `json:"now"`
+	Window int64           `json:"window"`
+	Links  []linkBatchItem `json:"links"`
+}
+
+type linkBatchItem struct {
+	ID         string   `json:"id"`
+	Sender     string   `json:"sender"`
+	Receiver   string   `json:"receiver"`
+	Unread     bool     `json:"unread"`
+	Address    string   `json:"address,omitempty"`
+	Normalized string   `json:"normalized,omitempty"`
+	URLID      string   `json:"url_id,omitempty"`
+	Verdict    string   `json:"verdict,omitempty"`
+	Screened   string   `json:"screened,omitempty"`
+	Fields     []string `json:"fields"`
+}
+
+// addLinksScript reserves URLs, stores links and updates every index for a
+// batch of links in a single step, so a failure can't leave partial state.
+// Redis doesn't undo the writes a script made before it failed, so every
+// key the batch will write is checked before the first write happens.
+// IDs are passed and returned as strings because Lua numbers are doubles.
+const addLinksScript = `
+local batch = cjson.decode(ARGV[1])
+local owners = {}
+local function owner(device)
+	if not owners[device] then
+		owners[device] = redis.call('HGET', 'devices:' .. device, 'user_id') or '0'
+	end
+	return owners[device]
+end
+local writes = {{'urls_to_ids', 'hash'}}
+for _, link in ipairs(batch.links) do
+	if #link.fields == 0 or #link.fields % 2 ~= 0 then
+		return redis.error_reply('ERR invalid fields for link ' .. link.id)
+	end
+	if redis.call('EXISTS', 'links:' .. link.id) == 1 then
+		return redis.error_reply('ERR link ' .. link.id .. ' already exists')
+	end
+	if link.normalized then
+		local url_id = redis.call('HGET', 'urls_to_ids', link.normalized) or link.url_id
+		table.insert(writes, {'urls:' .. url_id, 'hash'})
+		if batch.window > 0 then
+			table.insert(writes, {'recent_links:' .. link.sender .. ':' .. link.receiver .. ':' .. url_id, 'string'})
+		end
+	end
+	for _, scope in ipairs({'devices:' .. link.sender, 'users:' .. owner(link.sender)}) do
+		table.insert(writes, {scope .. ':links:sent', 'list'})
+	end
+	for _, scope in ipairs({'devices:' .. link.receiver, 'users:' .. owner(link.receiver)}) do
+		table.insert(writes, {scope .. ':links:received', 'list'})
+		if link.unread then
+			table.insert(writes, {scope .. ':links:unread', 'list'})
+			table.insert(writes, {scope .. ':unread_counts', 'hash'})
+		end
+	end
+end
+for _, write in ipairs(writes) do
+	local kind = redis.call('TYPE', write[1])['ok']
+	if kind ~= 'none' and kind ~= write[2] then
+		return redis.error_reply('WRONGTYPE ' .. write[1] .. ' is a ' .. kind .. ', not a ' .. write[2])
+	end
+end
+local results = {}
+for i, link in ipairs(batch.links) do
+	local status = 'new'
+	local link_id = link.id
+	local url_id = ''
+	local recent = nil
+	if link.normalized then
+		url_id = redis.call('HGET', 'urls_to_ids', link.normalized)
+		if url_id then
+			status = 'url'
+		else
+			url_id = link.url_id
+			status = 'new_url'
+			redis.call('HSET', 'urls_to_ids', link.normalized, url_id)
+			redis.call('HMSET', 'urls:' .. url_id, 'first_seen', batch.now, 'sent_counter', 0, 'address', link.address)
+		end
+		if link.verdict then
+			redis.call('HMSET', 'urls:' .. url_id, 'verdict', link.verdict, 'screened', link.screened)
+		end
+		if batch.window > 0 then
+			recent = 'recent_links:' .. link.sender .. ':' .. link.receiver .. ':' .. url_id
+			local existing = redis.call('GET', recent)
+			if existing and redis.call('EXISTS', 'links:' .. existing) == 1 then
+				status = 'duplicate'
+				link_id = existing
+			end
+		end
+	end
+	if status ~= 'duplicate' then
+		redis.call('HMSET', 'links:' .. link_id, unpack(link.fields))
+		if url_id ~= '' then
+			redis.call('HSET', 'links:' .. link_id, 'url', url_id)
+			redis.call('HINCRBY', 'urls:' .. url_id, 'sent_counter', 1)
+		end
+		if recent then
+			redis.call('SETEX', recent, batch.window, link_id)
+		end
+		redis.call('LPUSH', 'devices:' .. link.sender .. ':links:sent', link_id)
+		redis.call('LPUSH', 'users:' .. owner(link.sender) .. ':links:sent', link_id)
+		if link.unread then
+			redis.call('LPUSH', 'devices:' .. link.receiver .. ':links:unread', link_id)
+			redis.call('LPUSH', 'users:' .. owner(link.receiver) .. ':links:unread', link_id)
+			redis.call('HINCRBY', 'devices:' .. link.receiver .. ':unread_counts', 'links', 1)
+			redis.call('HINCRBY', 'users:' .. owner(link.receiver) .. ':unread_counts', 'links', 1)
+		end
+		redis.call('LPUSH', 'devices:' .. link.receiver .. ':links:received', link_id)
+		redis.call('LPUSH', 'users:' .. owner(link.receiver) .. ':links:received', link_id)
+	end
+	results[i] = {status, link_id, url_id}
+end
+return results
+`
+
+// updateLinkScript changes a link's comment and moves it in or out of its
+// receiver's unread lists, adjusting the unread counters by however many
+// entries actually moved. An empty unread leaves the unread state alone.
+// The keys are checked before anything is written, so a failure leaves the
+// link as it was.
+const updateLinkScript = `
+local link_id, receiver, set_comment, comment, unread, time_read = ARGV[1], ARGV[2], ARGV[3], ARGV[4], ARGV[5], ARGV[6]
+local owner = redis.call('HGET', 'devices:' .. receiver, 'user_id') or '0'
+local scopes = {'devices:' .. receiver, 'users:' .. owner}
+local writes = {{'links:' .. link_id, 'hash'}}
+if unread ~= '' then
+	for _, scope in ipairs(scopes) do
+		table.insert(writes, {scope .. ':links:unread', 'list'})
+		table.insert(writes, {scope .. ':unread_counts', 'hash'})
+	end
+end
+for _, write in ipairs(writes) do
+	local kind = redis.call('TYPE', write[1])['ok']
+	if kind ~= 'none' and kind ~= write[2] then
+		return redis.error_reply('WRONGTYPE ' .. write[1] .. ' is a ' .. kind .. ', not a ' .. write[2])
+	end
+end
+if set_comment == '1' then
+	redis.call('HSET', 'links:' .. link_id, 'comment', comment)
+end
+if unread == '' then
+	return 1
+end
+redis.call('HMSET', 'links:' .. link_id, 'unread', unread, 'time_read', time_read)
+for _, scope in ipairs(scopes) do
+	local removed = redis.call('LREM', scope .. ':links:unread', 0, link_id)
+	local added = 0
+	if unread == '1' then
+		redis.call('LPUSH', scope .. ':links:unread', link_id)
+		added = 1
+	end
+	redis.call('HINCRBY', scope .. ':unread_counts', 'links', added - removed)
+end
+return 1
+`
+
+func (r *RequestBundle) getURL(id uint64) (*URL, error) {
 	// start instrumentation
-	var err error
-	address, err = purell.NormalizeURLString(address, purell.FlagsSafe)
-	if err != nil {
-		r.Log.Error(err.Error())
-		return uint64(0), err
-	}
-	reply := r.Repo.client.Hget("urls_to_ids", address)
-	// report repo call to instrumentation
+	reply := r.Repo.client.Hgetall("urls:" + strconv.FormatUint(id, 10))
+	// add repo call to instrumentation
 	if reply.Err != nil {
 		r.Log.Error(reply.Err.Error())
-		return uint64(0), reply.Err
+		return nil, reply.Err
+	}
+	if reply.Type == redis.ReplyNil {
+		return nil, URLNotFoundError
 	}
-	idstr, err := reply.Str()
+	hash, err := reply.Hash()
 	if err != nil {
 		r.Log.Error(err.Error())
-		return uint64(0), err
+		return nil, err
 	}
-	id, err := strconv.ParseUint(idstr, 10, 64)
+	first_seen, err := time.Parse(time.RFC3339, hash["first_seen"])
 	if err != nil {
 		r.Log.Error(err.Error())
-		return uint64(0), err
+		return nil, err
 	}
-	return id, nil
-	// stop instrumentation
-}
-
-func (r *RequestBundle) reserveAddress(address string, id uint64) (bool, error) {
-	// start instrumentation
-	var err error
-	address, err = purell.NormalizeURLString(address, purell.FlagsSafe)
+	sent_counter, err := strconv.ParseInt(hash["sent_counter"], 10, 64)
 	if err != nil {
 		r.Log.Error(err.Error())
-		return false, err
+		return nil, err
 	}
-	reply := r.Repo.client.Hsetnx("urls_to_ids", address, id)
-	// report repo call to instrumentation
-	if reply.Err != nil {
-		r.Log.Error(reply.Err.Error())
-		return false, reply.Err
+	url := &URL{
+		ID:          id,
+		FirstSeen:   first_seen,
+		SentCounter: sent_counter,
+		Address:     hash["address"],
+		Verdict:     Verdict(hash["verdict"]),
+	}
+	if hash["screened"] != "" {
+		url.Screened, err = time.Parse(time.RFC3339, hash["screened"])
+		if err != nil {
+			r.Log.Error(err.Error())
+			return nil, err
+		}
 	}
-	r.Audit("urls_to_ids", address, "", strconv.FormatUint(id, 10))
-	// report repo calls to instrumentation
 	// stop instrumentation
-	return reply.Bool()
+	return url, nil
 }
 
-func (r *RequestBundle) releaseAddress(address string) error {
+func (r *RequestBundle) UpdateLink(link Link, unread bool, comment string) (Link, error) {
 	// start instrumentation
-	var err error
-	address, err = purell.NormalizeURLString(address, purell.FlagsSafe)
-	if err != nil {
-		r.Log.Error(err.Error())
-		return err
+	if link.Unread != unread {
+		link.TimeRead = time.Now()
 	}
-	reply := r.Repo.client.Hget("urls_to_ids", address)
-	// report the repo call to instrumentation
-	if reply.Err != nil {
-		r.Log.Error(reply.Err.Error())
-		return reply.Err
+	link.Unread = unread
+	comment = strings.TrimSpace(comment)
+	if comment != "" {
+		link.Comment = comment
 	}
-	if reply.Type == redis.ReplyNil {
-		return nil
-	}
-	was, err := reply.Str()
+	err := r.storeLinks([]Link{link}, true)
+	// add repo calls to instrumentation
 	if err != nil {
 		r.Log.Error(err.Error())
-		return err
-	}
-	reply = r.Repo.client.Hdel("urls_to_ids", address)
-	// report the repo call to instrumentation
-	if reply.Err != nil {
-		r.Log.Error(err.Error())
-		return reply.Err
+		return Link{}, err
 	}
-	r.Audit("urls_to_ids", address, was, "")
-	// report repo calls to instrumentation
 	// stop instrumentation
-	return nil
-}
-
-func (r *RequestBundle) incrementURL(id uint64, count int) error {
-	r.Log.Debug("About to increment urls:%d by %d", id, count)
-	reply := r.Repo.client.Hincrby("urls:"+strconv.FormatUint(id, 10), "sent_counter", count)
-	if reply.Err != nil {
-		r.Log.Error(reply.Err.Error())
-		return reply.Err
-	}
-	return nil
-}
-
-func (r *RequestBundle) UpdateLink(link Link, unread bool, comment string) (Link, error) {
-	return Link{}, nil
+	return link, nil
 }
 
 func (r *RequestBundle) DeleteLink(link Link) error {
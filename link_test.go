@@ -0,0 +1,205 @@
+package twocloud
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func testLink(id, urlID uint64, sender, receiver uint64) Link {
+	return Link{
+		ID:       id,
+		Kind:     PayloadURL,
+		URL:      &URL{ID: urlID, Address: "http://example.com/"},
+		Unread:   true,
+		Sender:   Device{ID: sender},
+		Receiver: Device{ID: receiver},
+		Sent:     time.Now(),
+	}
+}
+
+// linkKeys are the keys written when link 100 for URL 200 is sent from
+// device 1 (user 10) to device 2 (user 20).
+var linkKeys = []string{
+	"links:100",
+	"urls:200",
+	"urls_to_ids",
+	"recent_links:1:2:200",
+	"devices:1:links:sent",
+	"users:10:links:sent",
+	"devices:2:links:received",
+	"users:20:links:received",
+	"devices:2:links:unread",
+	"users:20:links:unread",
+	"devices:2:unread_counts",
+}
+
+func TestStoreLinksWritesEveryIndex(t *testing.T) {
+	r, server := testBundle(t)
+	testDevice(t, r, "1", "10")
+	testDevice(t, r, "2", "20")
+	err := r.storeLinks([]Link{testLink(100, 200, 1, 2)}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range linkKeys {
+		if !server.Exists(key) {
+			t.Errorf("%s wasn't written.", key)
+		}
+	}
+}
+
+func TestStoreLinksLeavesNothingWhenEvalFails(t *testing.T) {
+	r, server := testBundle(t)
+	testDevice(t, r, "1", "10")
+	testDevice(t, r, "2", "20")
+	server.SetError("ERR injected failure")
+	err := r.storeLinks([]Link{testLink(100, 200, 1, 2)}, false)
+	server.SetError("")
+	if err == nil {
+		t.Fatal("Expected storing the link to fail.")
+	}
+	assertNoKeys(t, server, linkKeys...)
+	assertKeyCount(t, server, 4)
+}
+
+func TestStoreLinksLeavesNothingWhenScriptFails(t *testing.T) {
+	r, server := testBundle(t)
+	testDevice(t, r, "1", "10")
+	testDevice(t, r, "2", "20")
+	// the receiving user's counters are the last thing the script writes
+	reply := r.Repo.client.Set("users:20:unread_counts", "broken")
+	if reply.Err != nil {
+		t.Fatal(reply.Err)
+	}
+	err := r.storeLinks([]Link{testLink(100, 200, 1, 2)}, false)
+	if err == nil {
+		t.Fatal("Expected storing the link to fail.")
+	}
+	assertNoKeys(t, server, linkKeys...)
+}
+
+func TestStoreLinksFailsBatchAsAWhole(t *testing.T) {
+	r, server := testBundle(t)
+	testDevice(t, r, "1", "10")
+	testDevice(t, r, "2", "20")
+	testDevice(t, r, "3", "30")
+	reply := r.Repo.client.Set("devices:3:links:received", "broken")
+	if reply.Err != nil {
+		t.Fatal(reply.Err)
+	}
+	links := []Link{testLink(100, 200, 1, 2), testLink(101, 201, 1, 3)}
+	err := r.storeLinks(links, false)
+	if err == nil {
+		t.Fatal("Expected storing the links to fail.")
+	}
+	assertNoKeys(t, server, append(linkKeys, "links:101", "devices:3:links:unread", "users:30:links:received", "users:30:unread_counts")...)
+}
+
+func TestAddLinksScriptRejectsInvalidFields(t *testing.T) {
+	r, server := testBundle(t)
+	testDevice(t, r, "1", "10")
+	testDevice(t, r, "2", "20")
+	batch := linkBatch{
+		Now: time.Now().Format(time.RFC3339),
+		Links: []linkBatchItem{
+			{ID: "100", Sender: "1", Receiver: "2", Unread: true, Address: "http://example.com/", Normalized: "http://example.com/", URLID: "200", Fields: []string{"kind", "url"}},
+			{ID: "101", Sender: "1", Receiver: "2", Unread: true, Fields: []string{"kind"}},
+		},
+	}
+	encoded, err := json.Marshal(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := r.Repo.client.Eval(addLinksScript, 0, string(encoded))
+	if reply.Err == nil {
+		t.Fatal("Expected the script to fail.")
+	}
+	assertNoKeys(t, server, append(linkKeys, "links:101")...)
+}
+
+func TestUpdateLinkLeavesLinkWhenScriptFails(t *testing.T) {
+	r, _ := testBundle(t)
+	testDevice(t, r, "1", "10")
+	testDevice(t, r, "2", "20")
+	link := testLink(100, 200, 1, 2)
+	link.Comment = "before"
+	err := r.storeLinks([]Link{link}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := r.Repo.client.Del("users:20:links:unread")
+	if reply.Err != nil {
+		t.Fatal(reply.Err)
+	}
+	reply = r.Repo.client.Set("users:20:links:unread", "broken")
+	if reply.Err != nil {
+		t.Fatal(reply.Err)
+	}
+	link.Comment = "after"
+	link.Unread = false
+	err = r.storeLinks([]Link{link}, true)
+	if err == nil {
+		t.Fatal("Expected updating the link to fail.")
+	}
+	reply = r.Repo.client.Hgetall("links:100")
+	if reply.Err != nil {
+		t.Fatal(reply.Err)
+	}
+	hash, err := reply.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash["comment"] != "before" || hash["unread"] != "1" {
+		t.Errorf("Link changed to comment %q, unread %q.", hash["comment"], hash["unread"])
+	}
+	reply = r.Repo.client.Hget("devices:2:unread_counts", "links")
+	if reply.Err != nil {
+		t.Fatal(reply.Err)
+	}
+	count, err := reply.Str()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != "1" {
+		t.Errorf("Receiver's unread count changed to %s.", count)
+	}
+}
+
+// AddLinks reserves IDs and writes the file before storing the link, so a
+// failure storing it has to undo those and leave no index entries behind.
+func TestAddLinksUndoesReservationWhenStoreFails(t *testing.T) {
+	r, server := testBundle(t)
+	testDevice(t, r, "1", "10")
+	testDevice(t, r, "2", "20")
+	dir := t.TempDir()
+	blobs, err := NewFileBlobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Blobs = blobs
+	reply := r.Repo.client.Set("users:20:unread_counts", "broken")
+	if reply.Err != nil {
+		t.Fatal(reply.Err)
+	}
+	_, err = r.AddLinks([]Link{{
+		Kind:     PayloadFile,
+		Payload:  &Payload{FileName: "notes.txt", Data: []byte("notes")},
+		Unread:   true,
+		Sender:   Device{ID: 1},
+		Receiver: Device{ID: 2},
+	}})
+	if err == nil {
+		t.Fatal("Expected adding the link to fail.")
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) > 0 {
+		t.Errorf("%s was left in the blob store.", files[0].Name())
+	}
+	// the four device fixtures and the broken counter
+	assertKeyCount(t, server, 5)
+}
@@ -0,0 +1,111 @@
+package twocloud
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+type MailMessage struct {
+	From    string
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+type MailTransport interface {
+	Send(message MailMessage) error
+}
+
+var NoMailTransportError = errors.New("No mail transport is configured.")
+var MissingRecipientError = errors.New("A mail message must have a recipient.")
+
+// Bytes renders the message as a multipart/alternative MIME document with
+// a plain text part and an HTML part.
+func (m MailMessage) Bytes() ([]byte, error) {
+	if m.To == "" {
+		return nil, MissingRecipientError
+	}
+	body := &bytes.Buffer{}
+	parts := multipart.NewWriter(body)
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	} {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", part.contentType)
+		header.Set("Content-Transfer-Encoding", "8bit")
+		writer, err := parts.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		_, err = writer.Write([]byte(part.content))
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := parts.Close()
+	if err != nil {
+		return nil, err
+	}
+	message := &bytes.Buffer{}
+	message.WriteString("From: " + m.From + "\r\n")
+	message.WriteString("To: " + m.To + "\r\n")
+	message.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", m.Subject) + "\r\n")
+	message.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: multipart/alternative; boundary=" + parts.Boundary() + "\r\n\r\n")
+	message.Write(body.Bytes())
+	return message.Bytes(), nil
+}
+
+// MaildirTransport delivers messages into a local maildir instead of sending
+// them, which is useful in development and for handing mail off to another
+// process.
+type MaildirTransport struct {
+	root    string
+	counter uint64
+}
+
+func NewMaildirTransport(root string) (*MaildirTransport, error) {
+	for _, dir := range []string{"tmp", "new", "cur"} {
+		err := os.MkdirAll(filepath.Join(root, dir), 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &MaildirTransport{
+		root: root,
+	}, nil
+}
+
+func (m *MaildirTransport) Send(message MailMessage) error {
+	contents, err := message.Bytes()
+	if err != nil {
+		return err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	count := atomic.AddUint64(&m.counter, 1)
+	name := strconv.FormatInt(time.Now().UnixNano(), 10) + "." + strconv.Itoa(os.Getpid()) + "_" + strconv.FormatUint(count, 10) + "." + hostname
+	tmp := filepath.Join(m.root, "tmp", name)
+	err = ioutil.WriteFile(tmp, contents, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(m.root, "new", name))
+}
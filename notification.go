@@ -1,37 +1,93 @@
 package twocloud
 
 import (
+	"encoding/json"
 	"errors"
+	"github.com/fzzbt/radix/redis"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type Notification struct {
-	ID              uint64    `json:"id,omitempty"`
-	Nature          string    `json:"nature,omitempty"`
-	Body            string    `json:"body,omitempty"`
-	Unread          bool      `json:"unread,omitempty"`
-	ReadBy          uint64    `json:"read_by,omitempty"`
-	TimeRead        time.Time `json:"time_read,omitempty"`
-	Sent            time.Time `json:"sent,omitempty"`
-	Destination     uint64    `json:"owner,omitempty"`
-	DestinationType string    `json:"owner_type,omitempty"`
+	ID              uint64            `json:"id,omitempty"`
+	Nature          string            `json:"nature,omitempty"`
+	Body            string            `json:"body,omitempty"`
+	Unread          bool              `json:"unread,omitempty"`
+	ReadBy          uint64            `json:"read_by,omitempty"`
+	TimeRead        time.Time         `json:"time_read,omitempty"`
+	Sent            time.Time         `json:"sent,omitempty"`
+	Destination     uint64            `json:"owner,omitempty"`
+	DestinationType string            `json:"owner_type,omitempty"`
+	Params          map[string]string `json:"params,omitempty"`
+	Priority        Priority          `json:"priority,omitempty"`
+	TTL             time.Duration     `json:"ttl,omitempty"`
+	Expires         time.Time         `json:"expires,omitempty"`
+	CollapseKey     string            `json:"collapse_key,omitempty"`
+	Muted           bool              `json:"muted,omitempty"`
+	Templated       bool              `json:"templated,omitempty"`
+	Channels        *Channels         `json:"channels,omitempty"`
+}
+
+type Priority int
+
+const (
+	PriorityNormal = Priority(iota)
+	PriorityLow
+	PriorityHigh
+)
+
+func (n *Notification) IsExpired() bool {
+	return !n.Expires.IsZero() && n.Expires.Before(time.Now())
+}
+
+// InApp reports whether a notification belongs in the app's notification
+// lists. Notifications stored before channel preferences existed do.
+func (n *Notification) InApp() bool {
+	return n.Channels == nil || n.Channels.InApp
+}
+
+// InDigest reports whether a notification belongs in the user's email
+// digest: they asked for it by email, or it was sent at low priority and so
+// was never pushed.
+func (n *Notification) InDigest() bool {
+	return (n.Channels != nil && n.Channels.Email) || n.Priority == PriorityLow
+}
+
+// ShouldPush reports whether a notification warrants an immediate push.
+// Low priority notifications wait for the user's next digest instead, and
+// notifications muted by the user's preferences are never pushed.
+func (n *Notification) ShouldPush() bool {
+	return n.Priority != PriorityLow && !n.Muted
 }
 
 type BroadcastFilter struct {
-	Targets    string   `json:"targets,omitempty"`
-	ClientType []string `json:"client_type,omitempty"`
+	Targets      string    `json:"targets,omitempty"`
+	ClientType   []string  `json:"client_type,omitempty"`
+	Subscription string    `json:"subscription,omitempty"`
+	ActiveAfter  time.Time `json:"active_after,omitempty"`
+	ActiveBefore time.Time `json:"active_before,omitempty"`
 }
 
+// IsValid checks the filter against the built-in client types. Use
+// IsValidIn to include configured and stored types.
 func (b *BroadcastFilter) IsValid() bool {
+	return b.IsValidIn(NewClientTypeRegistry(builtinClientTypes...))
+}
+
+func (b *BroadcastFilter) IsValidIn(types *ClientTypeRegistry) bool {
 	if b.Targets != "devices" && b.Targets != "users" {
 		return false
 	}
 	for _, t := range b.ClientType {
-		for _, clientType := range validClientTypes {
-			if t == clientType {
-				continue
-			}
+		if _, exists := types.Get(t); !exists {
+			return false
 		}
+	}
+	if b.Subscription != "" && b.Subscription != "active" && b.Subscription != "grace" && b.Subscription != "expired" {
+		return false
+	}
+	if !b.ActiveAfter.IsZero() && !b.ActiveBefore.IsZero() && b.ActiveBefore.Before(b.ActiveAfter) {
 		return false
 	}
 	return true
@@ -39,39 +95,547 @@ func (b *BroadcastFilter) IsValid() bool {
 
 var InvalidBroadcastFilter = errors.New("Invalid broadcast filter.")
 
+var NotificationNotFoundError = errors.New("Notification not found.")
+var InvalidNotificationError = errors.New("A notification must have a nature and a body.")
+
 func (r *RequestBundle) GetNotificationsByDevice(device Device, before, after uint64, count int) ([]Notification, error) {
-	return []Notification{}, nil
+	return r.getNotificationsByKey("devices:"+strconv.FormatUint(device.ID, 10)+":notifications", before, after, count)
 }
 
 func (r *RequestBundle) GetNotificationsByUser(user User, before, after uint64, count int) ([]Notification, error) {
-	return []Notification{}, nil
+	return r.getNotificationsByKey("users:"+strconv.FormatUint(user.ID, 10)+":notifications", before, after, count)
+}
+
+func (r *RequestBundle) GetUnreadNotificationsByDevice(device Device, before, after uint64, count int) ([]Notification, error) {
+	return r.getNotificationsByKey("devices:"+strconv.FormatUint(device.ID, 10)+":notifications:unread", before, after, count)
+}
+
+func (r *RequestBundle) GetUnreadNotificationsByUser(user User, before, after uint64, count int) ([]Notification, error) {
+	return r.getNotificationsByKey("users:"+strconv.FormatUint(user.ID, 10)+":notifications:unread", before, after, count)
+}
+
+func (r *RequestBundle) getNotificationsByKey(key string, before, after uint64, count int) ([]Notification, error) {
+	// start instrumentation
+	reply := r.Repo.client.Lrange(key, 0, -1)
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return []Notification{}, reply.Err
+	}
+	if reply.Type == redis.ReplyNil {
+		return []Notification{}, nil
+	}
+	ids, err := reply.List()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return []Notification{}, err
+	}
+	ids = pageIDs(ids, before, after, count)
+	reply = r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		for _, id := range ids {
+			mc.Hgetall("notifications:" + id)
+		}
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return []Notification{}, reply.Err
+	}
+	notifications := []Notification{}
+	for pos, elem := range reply.Elems {
+		if elem.Type == redis.ReplyNil {
+			continue
+		}
+		hash, err := elem.Hash()
+		if err != nil {
+			r.Log.Error(err.Error())
+			continue
+		}
+		id, err := strconv.ParseUint(ids[pos], 10, 64)
+		if err != nil {
+			r.Log.Error(err.Error())
+			continue
+		}
+		notification, err := notificationFromHash(id, hash)
+		if err != nil {
+			r.Log.Error(err.Error())
+			continue
+		}
+		if notification.IsExpired() {
+			continue
+		}
+		notifications = append(notifications, notification)
+	}
+	// stop instrumentation
+	return notifications, nil
+}
+
+func notificationFromHash(id uint64, hash map[string]string) (Notification, error) {
+	sent, err := time.Parse(time.RFC3339, hash["sent"])
+	if err != nil {
+		return Notification{}, err
+	}
+	time_read, err := time.Parse(time.RFC3339, hash["time_read"])
+	if err != nil {
+		return Notification{}, err
+	}
+	destination, err := strconv.ParseUint(hash["destination"], 10, 64)
+	if err != nil {
+		return Notification{}, err
+	}
+	read_by := uint64(0)
+	if hash["read_by"] != "" {
+		read_by, err = strconv.ParseUint(hash["read_by"], 10, 64)
+		if err != nil {
+			return Notification{}, err
+		}
+	}
+	notification := Notification{
+		ID:              id,
+		Nature:          hash["nature"],
+		Body:            hash["body"],
+		Unread:          hash["unread"] == "1",
+		ReadBy:          read_by,
+		TimeRead:        time_read,
+		Sent:            sent,
+		Destination:     destination,
+		DestinationType: hash["destination_type"],
+		CollapseKey:     hash["collapse_key"],
+		Templated:       hash["templated"] == "1",
+	}
+	if hash["channels"] != "" {
+		channels := parseChannels(hash["channels"])
+		notification.Channels = &channels
+	}
+	if hash["params"] != "" {
+		err = json.Unmarshal([]byte(hash["params"]), &notification.Params)
+		if err != nil {
+			return Notification{}, err
+		}
+	}
+	if hash["priority"] != "" {
+		priority, err := strconv.Atoi(hash["priority"])
+		if err != nil {
+			return Notification{}, err
+		}
+		notification.Priority = Priority(priority)
+	}
+	if hash["expires"] != "" {
+		notification.Expires, err = time.Parse(time.RFC3339, hash["expires"])
+		if err != nil {
+			return Notification{}, err
+		}
+	}
+	return notification, nil
 }
 
 func (r *RequestBundle) GetNotification(id uint64) (Notification, error) {
-	return Notification{}, nil
+	// start instrumentation
+	reply := r.Repo.client.Hgetall("notifications:" + strconv.FormatUint(id, 10))
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return Notification{}, reply.Err
+	}
+	if reply.Type == redis.ReplyNil {
+		return Notification{}, NotificationNotFoundError
+	}
+	hash, err := reply.Hash()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return Notification{}, err
+	}
+	notification, err := notificationFromHash(id, hash)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return Notification{}, err
+	}
+	// stop instrumentation
+	return notification, nil
+}
+
+func (r *RequestBundle) SendNotificationsToUser(user User, notifications []Notification) ([]Notification, error) {
+	// start instrumentation
+	for pos, _ := range notifications {
+		notifications[pos].Destination = user.ID
+		notifications[pos].DestinationType = "user"
+	}
+	notifications, err := r.applyPreferences(notifications, user.ID)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return []Notification{}, err
+	}
+	if len(notifications) < 1 {
+		return notifications, nil
+	}
+	err = r.storeNotifications(notifications, user.ID)
+	// add repo calls to instrumentation
+	if err != nil {
+		r.Log.Error(err.Error())
+		return []Notification{}, err
+	}
+	devices, err := r.GetDevicesByUser(user)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return notifications, nil
+	}
+	r.pushNotifications(notifications, activeDevices(devices))
+	// stop instrumentation
+	return notifications, nil
 }
 
-func (r *RequestBundle) SendNotificationsToUser(user User, notification []Notification) ([]Notification, error) {
-	return []Notification{}, nil
+func (r *RequestBundle) SendNotificationsToDevice(device Device, notifications []Notification) ([]Notification, error) {
+	// start instrumentation
+	for pos, _ := range notifications {
+		notifications[pos].Destination = device.ID
+		notifications[pos].DestinationType = "device"
+	}
+	notifications, err := r.applyPreferences(notifications, device.UserID)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return []Notification{}, err
+	}
+	if len(notifications) < 1 {
+		return notifications, nil
+	}
+	err = r.storeNotifications(notifications, device.UserID)
+	// add repo calls to instrumentation
+	if err != nil {
+		r.Log.Error(err.Error())
+		return []Notification{}, err
+	}
+	r.pushNotifications(notifications, []Device{device})
+	// stop instrumentation
+	return notifications, nil
+}
+
+func (r *RequestBundle) storeNotifications(notifications []Notification, user uint64) error {
+	// start instrumentation
+	err := r.renderNotifications(notifications, user)
+	if err != nil {
+		return err
+	}
+	for pos, notification := range notifications {
+		notification.Nature = strings.TrimSpace(notification.Nature)
+		if notification.Nature == "" || notification.Body == "" {
+			return InvalidNotificationError
+		}
+		id, err := r.GetID()
+		if err != nil {
+			r.Log.Error(err.Error())
+			return err
+		}
+		notifications[pos].ID = id
+		notifications[pos].Nature = notification.Nature
+		notifications[pos].Unread = true
+		notifications[pos].ReadBy = 0
+		notifications[pos].TimeRead = time.Time{}
+		notifications[pos].Sent = time.Now()
+		if notification.TTL > 0 {
+			notifications[pos].Expires = notifications[pos].Sent.Add(time.Second * notification.TTL)
+		}
+	}
+	// params are kept so templated notifications can be rendered again in
+	// each recipient's locale when they're delivered
+	params := map[uint64][]byte{}
+	for _, notification := range notifications {
+		if len(notification.Params) < 1 {
+			continue
+		}
+		params[notification.ID], err = json.Marshal(notification.Params)
+		if err != nil {
+			r.Log.Error(err.Error())
+			return err
+		}
+	}
+	userKey := "users:" + strconv.FormatUint(user, 10)
+	changes := map[uint64]map[string]interface{}{}
+	reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		for _, notification := range notifications {
+			values := map[string]interface{}{
+				"nature":           notification.Nature,
+				"body":             notification.Body,
+				"unread":           notification.Unread,
+				"read_by":          "",
+				"time_read":        notification.TimeRead.Format(time.RFC3339),
+				"sent":             notification.Sent.Format(time.RFC3339),
+				"destination":      notification.Destination,
+				"destination_type": notification.DestinationType,
+				"user_id":          user,
+				"priority":         int(notification.Priority),
+			}
+			if !notification.Expires.IsZero() {
+				values["expires"] = notification.Expires.Format(time.RFC3339)
+				mc.Zadd("notifications_by_expiration", notification.Expires.Unix(), notification.ID)
+			}
+			if notification.CollapseKey != "" {
+				values["collapse_key"] = notification.CollapseKey
+			}
+			if len(notification.Params) > 0 {
+				values["params"] = string(params[notification.ID])
+			}
+			if notification.Templated {
+				values["templated"] = boolString(true)
+			}
+			if notification.Channels != nil {
+				values["channels"] = notification.Channels.String()
+			}
+			changes[notification.ID] = values
+			mc.Hmset("notifications:"+strconv.FormatUint(notification.ID, 10), values)
+			scopes := []string{userKey}
+			if notification.DestinationType == "device" {
+				scopes = append(scopes, "devices:"+strconv.FormatUint(notification.Destination, 10))
+			}
+			for _, scope := range scopes {
+				// notifications kept out of the app are still indexed, so
+				// deleting their destination cleans them up
+				if !notification.InApp() {
+					mc.Lpush(scope+":notifications:hidden", notification.ID)
+					continue
+				}
+				mc.Lpush(scope+":notifications", notification.ID)
+				mc.Lpush(scope+":notifications:unread", notification.ID)
+				mc.Hincrby(scope+":unread_counts", "notifications", 1)
+			}
+			if notification.InDigest() {
+				mc.Lpush(userKey+":notifications:digest", notification.ID)
+			}
+		}
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return reply.Err
+	}
+	from := map[string]interface{}{
+		"nature":           "",
+		"body":             "",
+		"unread":           "",
+		"read_by":          "",
+		"time_read":        "",
+		"sent":             "",
+		"destination":      "",
+		"destination_type": "",
+		"user_id":          "",
+		"priority":         "",
+		"expires":          "",
+		"collapse_key":     "",
+		"params":           "",
+		"templated":        "",
+		"channels":         "",
+	}
+	for id, values := range changes {
+		r.AuditMap("notifications:"+strconv.FormatUint(id, 10), from, values)
+	}
+	// add repo calls to instrumentation
+	for _, notification := range notifications {
+		if notification.CollapseKey == "" {
+			continue
+		}
+		err = r.collapseNotification(notification, userKey)
+		if err != nil {
+			r.Log.Error(err.Error())
+		}
+	}
+	// stop instrumentation
+	return nil
 }
 
-func (r *RequestBundle) SendNotificationsToDevice(device Device, notification []Notification) ([]Notification, error) {
-	return []Notification{}, nil
+func (r *RequestBundle) collapseNotification(notification Notification, userKey string) error {
+	// start instrumentation
+	scope := userKey
+	if notification.DestinationType == "device" {
+		scope = "devices:" + strconv.FormatUint(notification.Destination, 10)
+	}
+	reply := r.Repo.client.Eval(collapseNotificationScript, 0, scope, notification.CollapseKey, notification.ID)
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return reply.Err
+	}
+	if reply.Type == redis.ReplyNil {
+		return nil
+	}
+	previous, err := reply.Str()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return err
+	}
+	reply = r.Repo.client.Eval(removeNotificationScript, 0, previous, "", "", "collapse")
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return reply.Err
+	}
+	removed, err := reply.Bool()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return err
+	}
+	if removed {
+		r.Audit("notifications:"+previous, "collapsed_by", "", strconv.FormatUint(notification.ID, 10))
+	}
+	// stop instrumentation
+	return nil
 }
 
-func (r *RequestBundle) BroadcastNotifications(notifications []Notification, filter *BroadcastFilter) ([]Notification, error) {
-	if filter != nil {
-		if !filter.IsValid() {
-			return []Notification{}, InvalidBroadcastFilter
+func (r *RequestBundle) ExpireNotifications() (int, error) {
+	// start instrumentation
+	reply := r.Repo.client.Zrangebyscore("notifications_by_expiration", "-inf", time.Now().Unix())
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return 0, reply.Err
+	}
+	if reply.Type == redis.ReplyNil {
+		return 0, nil
+	}
+	ids, err := reply.List()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return 0, err
+	}
+	expired := 0
+	for _, id := range ids {
+		reply = r.Repo.client.Eval(removeNotificationScript, 0, id, "", "", "delete")
+		// add repo call to instrumentation
+		if reply.Err != nil {
+			r.Log.Error(reply.Err.Error())
+			return expired, reply.Err
 		}
+		r.Audit("notifications:"+id, "expired", "", time.Now().Format(time.RFC3339))
+		expired++
 	}
-	return []Notification{}, nil
+	// stop instrumentation
+	return expired, nil
 }
 
 func (r *RequestBundle) MarkNotificationRead(notification Notification) (Notification, error) {
-	return Notification{}, nil
+	// start instrumentation
+	if !notification.Unread {
+		return notification, nil
+	}
+	now := time.Now()
+	reply := r.Repo.client.Eval(removeNotificationScript, 0, notification.ID, r.Device.ID, now.Format(time.RFC3339), "read")
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return Notification{}, reply.Err
+	}
+	found, err := reply.Bool()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return Notification{}, err
+	}
+	if !found {
+		return Notification{}, NotificationNotFoundError
+	}
+	from := map[string]interface{}{
+		"unread":    notification.Unread,
+		"read_by":   notification.ReadBy,
+		"time_read": notification.TimeRead.Format(time.RFC3339),
+	}
+	notification.Unread = false
+	notification.ReadBy = r.Device.ID
+	notification.TimeRead = now
+	to := map[string]interface{}{
+		"unread":    notification.Unread,
+		"read_by":   notification.ReadBy,
+		"time_read": notification.TimeRead.Format(time.RFC3339),
+	}
+	r.AuditMap("notifications:"+strconv.FormatUint(notification.ID, 10), from, to)
+	// add repo call to instrumentation
+	// stop instrumentation
+	return notification, nil
 }
 
 func (r *RequestBundle) DeleteNotification(notification Notification) error {
+	// start instrumentation
+	reply := r.Repo.client.Eval(removeNotificationScript, 0, notification.ID, "", "", "delete")
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return reply.Err
+	}
+	found, err := reply.Bool()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return err
+	}
+	if !found {
+		return NotificationNotFoundError
+	}
+	from := map[string]interface{}{
+		"nature":           notification.Nature,
+		"body":             notification.Body,
+		"unread":           notification.Unread,
+		"destination":      notification.Destination,
+		"destination_type": notification.DestinationType,
+	}
+	to := map[string]interface{}{
+		"nature":           "",
+		"body":             "",
+		"unread":           "",
+		"destination":      "",
+		"destination_type": "",
+	}
+	r.AuditMap("notifications:"+strconv.FormatUint(notification.ID, 10), from, to)
+	// add repo call to instrumentation
+	// stop instrumentation
 	return nil
 }
+
+// removeNotificationScript takes a notification out of the unread indexes,
+// keeping the unread counters in step, and out of every index when it is
+// deleted. The action is "read" to mark it read,
+// "delete" to remove it entirely, or "collapse" to remove it only if it is
+// still unread.
+const removeNotificationScript = `
+local id, read_by, time_read, action = ARGV[1], ARGV[2], ARGV[3], ARGV[4]
+local key = 'notifications:' .. id
+local notification = redis.call('HMGET', key, 'destination', 'destination_type', 'user_id', 'unread')
+if not notification[1] then
+	redis.call('ZREM', 'notifications_by_expiration', id)
+	return 0
+end
+if action == 'collapse' then
+	if notification[4] ~= '1' then
+		return 0
+	end
+	action = 'delete'
+end
+local scopes = {'users:' .. notification[3]}
+if notification[2] == 'device' then
+	table.insert(scopes, 'devices:' .. notification[1])
+end
+for _, scope in ipairs(scopes) do
+	local removed = redis.call('LREM', scope .. ':notifications:unread', 0, id)
+	redis.call('HINCRBY', scope .. ':unread_counts', 'notifications', -removed)
+	if action == 'delete' then
+		redis.call('LREM', scope .. ':notifications', 0, id)
+		redis.call('LREM', scope .. ':notifications:hidden', 0, id)
+	end
+end
+if action == 'delete' then
+	redis.call('LREM', 'users:' .. notification[3] .. ':notifications:digest', 0, id)
+end
+if action == 'delete' then
+	redis.call('DEL', key)
+	redis.call('ZREM', 'notifications_by_expiration', id)
+else
+	redis.call('HMSET', key, 'unread', '0', 'read_by', read_by, 'time_read', time_read)
+end
+return 1
+`
+
+// collapseNotificationScript points a destination's collapse key at a new
+// notification and returns the notification it replaced, if any.
+const collapseNotificationScript = `
+local scope, collapse_key, id = ARGV[1], ARGV[2], ARGV[3]
+local previous = redis.call('HGET', scope .. ':notifications:collapse', collapse_key)
+redis.call('HSET', scope .. ':notifications:collapse', collapse_key, id)
+if previous and previous ~= id then
+	return previous
+end
+return false
+`
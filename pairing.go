@@ -0,0 +1,199 @@
+package twocloud
+
+import (
+	"errors"
+	"github.com/fzzbt/radix/redis"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const pairingLifetime = 300
+const maxPairingAttempts = 5
+const maxPairingAttemptsPerIP = 20
+
+type PairingCode struct {
+	Code    [2]string `json:"code"`
+	Expires time.Time `json:"expires"`
+}
+
+var PairingAttemptsExceededError = errors.New("Too many attempts were made with that pairing code. Please request a new one.")
+var PairingThrottledError = errors.New("Too many pairing attempts were made from your address. Please try again later.")
+
+// RequestPairingCode gives an authenticated device a code that a new
+// device can redeem to be added to the same account. The code is made like
+// a pair of temporary credentials, but it's only stored in pairing:<first>,
+// along with which device asked for it and how many times it has been
+// tried, so it can't be used to log in.
+func (r *RequestBundle) RequestPairingCode(device Device) (PairingCode, error) {
+	// start instrumentation
+	creds := [2]string{GenerateTempCredentials(), GenerateTempCredentials()}
+	if creds[0] > creds[1] {
+		creds[0], creds[1] = creds[1], creds[0]
+	}
+	key := "pairing:" + creds[0]
+	reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		mc.Hmset(key, map[string]interface{}{
+			"secret":   creds[1],
+			"user_id":  device.UserID,
+			"device":   device.ID,
+			"attempts": 0,
+		})
+		mc.Expire(key, pairingLifetime)
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return PairingCode{}, reply.Err
+	}
+	r.Audit(key, "device", "", strconv.FormatUint(device.ID, 10))
+	// add repo call to instrumentation
+	// stop instrumentation
+	return PairingCode{
+		Code:    creds,
+		Expires: time.Now().Add(time.Second * pairingLifetime),
+	}, nil
+}
+
+// redeemPairingScript checks a pairing code and, when it matches, claims
+// it so nobody else can redeem it while the new device is added. Every
+// attempt counts against the code, which is deleted once it runs out, and
+// against the address it came from, which is turned away after too many
+// attempts at any code.
+const redeemPairingScript = `
+local first, second, limit = ARGV[1], ARGV[2], tonumber(ARGV[3])
+local ip, iplimit, lifetime = ARGV[4], tonumber(ARGV[5]), ARGV[6]
+if ip ~= '' then
+	local ikey = 'pairing_attempts:' .. ip
+	local tries = redis.call('INCR', ikey)
+	if tries == 1 then
+		redis.call('EXPIRE', ikey, lifetime)
+	end
+	if tries > iplimit then
+		return {'throttled'}
+	end
+end
+local pkey = 'pairing:' .. first
+local secret = redis.call('HGET', pkey, 'secret')
+if not secret or redis.call('HEXISTS', pkey, 'claimed') == 1 then
+	return {'invalid'}
+end
+local attempts = redis.call('HINCRBY', pkey, 'attempts', 1)
+if secret == second then
+	redis.call('HSET', pkey, 'claimed', 1)
+	return {'ok', redis.call('HGET', pkey, 'user_id'), redis.call('HGET', pkey, 'device')}
+end
+if attempts >= limit then
+	redis.call('DEL', pkey)
+	return {'exhausted'}
+end
+return {'invalid'}
+`
+
+// releasePairingCode gives up a claim on a pairing code when the device
+// couldn't be added, so it can be redeemed again.
+func (r *RequestBundle) releasePairingCode(first string) {
+	reply := r.Repo.client.Hdel("pairing:"+first, "claimed")
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+	}
+}
+
+// RedeemPairingCode adds a new device to the account that requested the
+// code, and returns it along with the token it should authenticate with.
+func (r *RequestBundle) RedeemPairingCode(code [2]string, name, client_type, ip string) (User, Device, string, error) {
+	// start instrumentation
+	first := strings.TrimSpace(code[0])
+	second := strings.TrimSpace(code[1])
+	if first > second {
+		first, second = second, first
+	}
+	if first == "" || second == "" {
+		return User{}, Device{}, "", InvalidCredentialsError
+	}
+	// check the client type first, so a typo doesn't use up the code
+	clientType, exists := r.clientTypes().Get(strings.TrimSpace(client_type))
+	if !exists {
+		return User{}, Device{}, "", InvalidClientType
+	}
+	if clientType.Deprecated {
+		return User{}, Device{}, "", DeprecatedClientTypeError
+	}
+	// addresses with a port would give each connection a limit of its own
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	reply := r.Repo.client.Eval(redeemPairingScript, 0, first, second, maxPairingAttempts, ip, maxPairingAttemptsPerIP, pairingLifetime)
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return User{}, Device{}, "", reply.Err
+	}
+	result, err := reply.List()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return User{}, Device{}, "", err
+	}
+	if len(result) < 1 || result[0] == "invalid" {
+		// add invalid credential error to stats
+		return User{}, Device{}, "", InvalidCredentialsError
+	}
+	if result[0] == "throttled" {
+		r.Log.Warn("Pairing attempts from %s throttled.", ip)
+		return User{}, Device{}, "", PairingThrottledError
+	}
+	if result[0] == "exhausted" {
+		r.Log.Warn("Pairing code %s exhausted its attempts.", first)
+		return User{}, Device{}, "", PairingAttemptsExceededError
+	}
+	if len(result) < 3 {
+		r.releasePairingCode(first)
+		return User{}, Device{}, "", UnexpectedReplyError
+	}
+	userID, err := strconv.ParseUint(result[1], 10, 64)
+	if err != nil {
+		r.Log.Error(err.Error())
+		r.releasePairingCode(first)
+		return User{}, Device{}, "", err
+	}
+	requesterID, err := strconv.ParseUint(result[2], 10, 64)
+	if err != nil {
+		r.Log.Error(err.Error())
+		r.releasePairingCode(first)
+		return User{}, Device{}, "", err
+	}
+	user, err := r.GetUser(userID)
+	if err != nil {
+		r.releasePairingCode(first)
+		return User{}, Device{}, "", err
+	}
+	device, token, err := r.AddDeviceWithToken(name, client_type, ip, "", user)
+	if err != nil {
+		r.releasePairingCode(first)
+		return User{}, Device{}, "", err
+	}
+	// the device exists now, so the code is used up
+	reply = r.Repo.client.Del("pairing:" + first)
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+	}
+	r.Audit("pairing:"+first, "redeemed_by", "", strconv.FormatUint(device.ID, 10))
+	// add repo call to instrumentation
+	requester, err := r.GetDevice(requesterID)
+	if err == nil {
+		_, err = r.SendNotificationsToDevice(requester, []Notification{{
+			Nature: "device_paired",
+			Params: map[string]string{
+				"device": device.Name,
+			},
+		}})
+	}
+	if err != nil {
+		r.Log.Error(err.Error())
+	}
+	// stop instrumentation
+	return user, device, token, nil
+}
@@ -0,0 +1,24 @@
+package twocloud
+
+import (
+	"testing"
+)
+
+func TestRedeemPairingCodeLimitsHostAcrossPorts(t *testing.T) {
+	r, server := testBundle(t)
+	code := [2]string{"first", "second"}
+	for i := 0; i < maxPairingAttemptsPerIP; i++ {
+		_, _, _, err := r.RedeemPairingCode(code, "Tablet", "android_tablet", "203.0.113.5:1111")
+		if err != InvalidCredentialsError {
+			t.Fatalf("Expected InvalidCredentialsError on attempt %d, got %v.", i+1, err)
+		}
+	}
+	_, _, _, err := r.RedeemPairingCode(code, "Tablet", "android_tablet", "203.0.113.5:2222")
+	if err != PairingThrottledError {
+		t.Errorf("Expected PairingThrottledError from another port, got %v.", err)
+	}
+	if !server.Exists("pairing_attempts:203.0.113.5") {
+		t.Error("Attempts weren't counted against the host.")
+	}
+	assertNoKeys(t, server, "pairing_attempts:203.0.113.5:1111", "pairing_attempts:203.0.113.5:2222")
+}
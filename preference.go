@@ -0,0 +1,297 @@
+package twocloud
+
+import (
+	"errors"
+	"github.com/fzzbt/radix/redis"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Channels struct {
+	InApp bool `json:"in_app"`
+	Push  bool `json:"push"`
+	Email bool `json:"email"`
+}
+
+func (c Channels) String() string {
+	enabled := []string{}
+	if c.InApp {
+		enabled = append(enabled, "in_app")
+	}
+	if c.Push {
+		enabled = append(enabled, "push")
+	}
+	if c.Email {
+		enabled = append(enabled, "email")
+	}
+	return strings.Join(enabled, ",")
+}
+
+func parseChannels(value string) Channels {
+	channels := Channels{}
+	for _, channel := range strings.Split(value, ",") {
+		switch channel {
+		case "in_app":
+			channels.InApp = true
+		case "push":
+			channels.Push = true
+		case "email":
+			channels.Email = true
+		}
+	}
+	return channels
+}
+
+type QuietHours struct {
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Timezone string `json:"timezone,omitempty"`
+}
+
+type DigestSchedule string
+
+const (
+	DigestNever  = DigestSchedule("")
+	DigestDaily  = DigestSchedule("daily")
+	DigestWeekly = DigestSchedule("weekly")
+)
+
+func (d DigestSchedule) IsValid() bool {
+	return d == DigestNever || d == DigestDaily || d == DigestWeekly
+}
+
+func (d DigestSchedule) Period() time.Duration {
+	if d == DigestWeekly {
+		return time.Hour * 24 * 7
+	}
+	return time.Hour * 24
+}
+
+type NotificationPreferences struct {
+	Default    Channels            `json:"default"`
+	Natures    map[string]Channels `json:"natures,omitempty"`
+	QuietHours *QuietHours         `json:"quiet_hours,omitempty"`
+	Digest     DigestSchedule      `json:"digest,omitempty"`
+}
+
+var InvalidQuietHoursError = errors.New("Quiet hours must be given as HH:MM in a valid timezone.")
+var InvalidDigestScheduleError = errors.New("Digests can only be sent daily or weekly.")
+
+func DefaultNotificationPreferences() NotificationPreferences {
+	return NotificationPreferences{
+		Default: Channels{
+			InApp: true,
+			Push:  true,
+			Email: false,
+		},
+		Natures: map[string]Channels{},
+	}
+}
+
+func (p NotificationPreferences) ChannelsFor(nature string) Channels {
+	if channels, set := p.Natures[nature]; set {
+		return channels
+	}
+	return p.Default
+}
+
+func parseClock(value string) (int, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+func (q *QuietHours) validate() error {
+	_, err := parseClock(q.Start)
+	if err != nil {
+		return InvalidQuietHoursError
+	}
+	_, err = parseClock(q.End)
+	if err != nil {
+		return InvalidQuietHoursError
+	}
+	if q.Timezone != "" {
+		_, err = time.LoadLocation(q.Timezone)
+		if err != nil {
+			return InvalidQuietHoursError
+		}
+	}
+	return nil
+}
+
+func (q *QuietHours) Contains(t time.Time, fallbackTimezone string) bool {
+	timezone := q.Timezone
+	if timezone == "" {
+		timezone = fallbackTimezone
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		location = time.UTC
+	}
+	start, err := parseClock(q.Start)
+	if err != nil {
+		return false
+	}
+	end, err := parseClock(q.End)
+	if err != nil {
+		return false
+	}
+	local := t.In(location)
+	now := local.Hour()*60 + local.Minute()
+	if start <= end {
+		return now >= start && now < end
+	}
+	// the quiet period wraps past midnight
+	return now >= start || now < end
+}
+
+func (r *RequestBundle) GetNotificationPreferences(user User) (NotificationPreferences, error) {
+	// start instrumentation
+	reply := r.Repo.client.Hgetall("users:" + strconv.FormatUint(user.ID, 10) + ":preferences")
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return NotificationPreferences{}, reply.Err
+	}
+	preferences := DefaultNotificationPreferences()
+	if reply.Type == redis.ReplyNil {
+		return preferences, nil
+	}
+	hash, err := reply.Hash()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return NotificationPreferences{}, err
+	}
+	for field, value := range hash {
+		if field == "default" {
+			preferences.Default = parseChannels(value)
+		} else if strings.HasPrefix(field, "nature:") {
+			preferences.Natures[strings.TrimPrefix(field, "nature:")] = parseChannels(value)
+		}
+	}
+	if hash["quiet_start"] != "" && hash["quiet_end"] != "" {
+		preferences.QuietHours = &QuietHours{
+			Start:    hash["quiet_start"],
+			End:      hash["quiet_end"],
+			Timezone: hash["quiet_timezone"],
+		}
+	}
+	preferences.Digest = DigestSchedule(hash["digest"])
+	// stop instrumentation
+	return preferences, nil
+}
+
+func (p NotificationPreferences) toHash() map[string]interface{} {
+	hash := map[string]interface{}{
+		"default": p.Default.String(),
+	}
+	for nature, channels := range p.Natures {
+		hash["nature:"+nature] = channels.String()
+	}
+	if p.QuietHours != nil {
+		hash["quiet_start"] = p.QuietHours.Start
+		hash["quiet_end"] = p.QuietHours.End
+		hash["quiet_timezone"] = p.QuietHours.Timezone
+	}
+	if p.Digest != DigestNever {
+		hash["digest"] = string(p.Digest)
+	}
+	return hash
+}
+
+func (r *RequestBundle) UpdateNotificationPreferences(user User, preferences NotificationPreferences) (NotificationPreferences, error) {
+	// start instrumentation
+	if !preferences.Digest.IsValid() {
+		return NotificationPreferences{}, InvalidDigestScheduleError
+	}
+	if preferences.QuietHours != nil {
+		err := preferences.QuietHours.validate()
+		if err != nil {
+			return NotificationPreferences{}, err
+		}
+	}
+	if preferences.Natures == nil {
+		preferences.Natures = map[string]Channels{}
+	}
+	old, err := r.GetNotificationPreferences(user)
+	if err != nil {
+		return NotificationPreferences{}, err
+	}
+	from := old.toHash()
+	to := preferences.toHash()
+	for field, _ := range from {
+		if _, set := to[field]; !set {
+			to[field] = ""
+		}
+	}
+	changes := map[string]interface{}{}
+	for field, value := range to {
+		if from[field] != value {
+			changes[field] = value
+		}
+	}
+	if len(changes) < 1 {
+		return preferences, nil
+	}
+	key := "users:" + strconv.FormatUint(user.ID, 10) + ":preferences"
+	reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		mc.Del(key)
+		mc.Hmset(key, preferences.toHash())
+		if preferences.Digest == old.Digest {
+			return
+		}
+		if preferences.Digest == DigestNever {
+			mc.Zrem("digests_due", user.ID)
+		} else {
+			mc.Zadd("digests_due", time.Now().Add(preferences.Digest.Period()).Unix(), user.ID)
+		}
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return NotificationPreferences{}, reply.Err
+	}
+	r.AuditMap(key, from, changes)
+	// add repo call to instrumentation
+	// stop instrumentation
+	return preferences, nil
+}
+
+func (r *RequestBundle) getUserTimezone(user uint64) string {
+	accounts, err := r.GetAccountsByUser(User{ID: user})
+	if err != nil {
+		r.Log.Error(err.Error())
+		return ""
+	}
+	for _, account := range accounts {
+		if account.Timezone != "" {
+			return account.Timezone
+		}
+	}
+	return ""
+}
+
+func (r *RequestBundle) applyPreferences(notifications []Notification, user uint64) ([]Notification, error) {
+	preferences, err := r.GetNotificationPreferences(User{ID: user})
+	if err != nil {
+		return []Notification{}, err
+	}
+	quiet := false
+	if preferences.QuietHours != nil {
+		quiet = preferences.QuietHours.Contains(time.Now(), r.getUserTimezone(user))
+	}
+	allowed := []Notification{}
+	for _, notification := range notifications {
+		channels := preferences.ChannelsFor(notification.Nature)
+		if !channels.InApp && !channels.Push && !channels.Email {
+			continue
+		}
+		notification.Channels = &channels
+		notification.Muted = !channels.Push || (quiet && notification.Priority != PriorityHigh)
+		allowed = append(allowed, notification)
+	}
+	return allowed, nil
+}
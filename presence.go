@@ -0,0 +1,284 @@
+package twocloud
+
+import (
+	"encoding/json"
+	"github.com/fzzbt/radix/redis"
+	"strconv"
+	"time"
+)
+
+type Presence string
+
+const (
+	PresenceOnline  = Presence("online")
+	PresenceIdle    = Presence("idle")
+	PresenceOffline = Presence("offline")
+)
+
+const defaultPresenceOnline = 90
+const defaultPresenceIdle = 900
+const presenceChannelPrefix = "presence:"
+
+// PresenceEvent is published to a user's presence channel whenever one of
+// their devices changes between online, idle and offline.
+type PresenceEvent struct {
+	Device   uint64    `json:"device"`
+	Presence Presence  `json:"presence"`
+	Changed  time.Time `json:"changed"`
+}
+
+func presenceChannel(user uint64) string {
+	return presenceChannelPrefix + strconv.FormatUint(user, 10)
+}
+
+func (r *RequestBundle) presenceOnline() time.Duration {
+	if r.Config.PresenceOnline < 1 {
+		return time.Second * defaultPresenceOnline
+	}
+	return time.Second * r.Config.PresenceOnline
+}
+
+func (r *RequestBundle) presenceIdle() time.Duration {
+	if r.Config.PresenceIdle < 1 {
+		return time.Second * defaultPresenceIdle
+	}
+	return time.Second * r.Config.PresenceIdle
+}
+
+// TouchDevicePresence marks a device as online. Presence is kept in two
+// expiring keys: the device is online while devices:<id>:presence:online
+// exists, idle while only devices:<id>:presence:idle does, and offline once
+// both have expired. presence_due holds when each device's presence next
+// changes, so ExpirePresence can announce it.
+func (r *RequestBundle) TouchDevicePresence(device Device) error {
+	// start instrumentation
+	online := r.presenceOnline()
+	idle := r.presenceIdle()
+	key := "devices:" + strconv.FormatUint(device.ID, 10) + ":presence"
+	reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		mc.Exists(key + ":online")
+		mc.Setex(key+":online", int64(online.Seconds()), "1")
+		mc.Setex(key+":idle", int64((online + idle).Seconds()), "1")
+		mc.Zadd("presence_due", time.Now().Add(online).Unix(), device.ID)
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return reply.Err
+	}
+	wasOnline, err := reply.Elems[0].Bool()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return err
+	}
+	if !wasOnline {
+		err = r.publishPresenceEvent(device.UserID, device.ID, PresenceOnline)
+		if err != nil {
+			return err
+		}
+	}
+	// stop instrumentation
+	return nil
+}
+
+// heartbeatPresence keeps a device online for as long as it holds a push
+// connection, until stop is closed.
+func (r *RequestBundle) heartbeatPresence(device Device, stop <-chan bool) {
+	err := r.TouchDevicePresence(device)
+	if err != nil {
+		r.Log.Error(err.Error())
+	}
+	ticker := time.NewTicker(r.presenceOnline() / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err = r.TouchDevicePresence(device)
+			if err != nil {
+				r.Log.Error(err.Error())
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (r *RequestBundle) publishPresenceEvent(user, device uint64, presence Presence) error {
+	payload, err := json.Marshal(PresenceEvent{
+		Device:   device,
+		Presence: presence,
+		Changed:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	reply := r.Repo.client.Publish(presenceChannel(user), string(payload))
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return reply.Err
+	}
+	return nil
+}
+
+// fillPresence sets the current presence of each device.
+func (r *RequestBundle) fillPresence(devices []Device) error {
+	if len(devices) < 1 {
+		return nil
+	}
+	reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		for _, device := range devices {
+			key := "devices:" + strconv.FormatUint(device.ID, 10) + ":presence"
+			mc.Exists(key + ":online")
+			mc.Exists(key + ":idle")
+		}
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return reply.Err
+	}
+	for pos, _ := range devices {
+		online, err := reply.Elems[pos*2].Bool()
+		if err != nil {
+			r.Log.Error(err.Error())
+			return err
+		}
+		idle, err := reply.Elems[pos*2+1].Bool()
+		if err != nil {
+			r.Log.Error(err.Error())
+			return err
+		}
+		devices[pos].Presence = PresenceOffline
+		if online {
+			devices[pos].Presence = PresenceOnline
+		} else if idle {
+			devices[pos].Presence = PresenceIdle
+		}
+	}
+	return nil
+}
+
+// ExpirePresence announces the devices that have gone idle or offline since
+// their last heartbeat, and schedules the next change for those that are
+// still idle.
+func (r *RequestBundle) ExpirePresence() (int, error) {
+	// start instrumentation
+	now := time.Now()
+	reply := r.Repo.client.Zrangebyscore("presence_due", "-inf", now.Unix())
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return 0, reply.Err
+	}
+	if reply.Type == redis.ReplyNil {
+		return 0, nil
+	}
+	ids, err := reply.List()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return 0, err
+	}
+	changed := 0
+	var lastErr error
+	for _, idstr := range ids {
+		id, err := strconv.ParseUint(idstr, 10, 64)
+		if err != nil {
+			r.Log.Error(err.Error())
+			continue
+		}
+		device, err := r.GetDevice(id)
+		if err == DeviceNotFoundError {
+			r.Repo.client.Zrem("presence_due", id)
+			// add repo call to instrumentation
+			continue
+		} else if err != nil {
+			lastErr = err
+			continue
+		}
+		key := "devices:" + idstr + ":presence"
+		reply = r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+			mc.Ttl(key + ":online")
+			mc.Ttl(key + ":idle")
+		})
+		// add repo call to instrumentation
+		if reply.Err != nil {
+			r.Log.Error(reply.Err.Error())
+			lastErr = reply.Err
+			continue
+		}
+		online, err := reply.Elems[0].Int64()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		idle, err := reply.Elems[1].Int64()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if online > 0 {
+			// a heartbeat arrived after the device was scheduled
+			r.Repo.client.Zadd("presence_due", now.Unix()+online, id)
+			// add repo call to instrumentation
+			continue
+		}
+		presence := PresenceOffline
+		if idle > 0 {
+			presence = PresenceIdle
+			reply = r.Repo.client.Zadd("presence_due", now.Unix()+idle, id)
+		} else {
+			reply = r.Repo.client.Zrem("presence_due", id)
+		}
+		// add repo call to instrumentation
+		if reply.Err != nil {
+			r.Log.Error(reply.Err.Error())
+			lastErr = reply.Err
+			continue
+		}
+		err = r.publishPresenceEvent(device.UserID, device.ID, presence)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		changed++
+	}
+	// stop instrumentation
+	return changed, lastErr
+}
+
+type PresenceSubscription struct {
+	subscription *redis.Subscription
+}
+
+// SubscribePresence calls handler with every presence change for the
+// user's devices until the subscription is closed.
+func (r *RequestBundle) SubscribePresence(user User, handler func(PresenceEvent)) (*PresenceSubscription, error) {
+	subscription, err := r.Repo.client.Subscription(func(message *redis.Message) {
+		if message.Type != redis.MessageMessage {
+			return
+		}
+		var event PresenceEvent
+		err := json.Unmarshal([]byte(message.Payload), &event)
+		if err != nil {
+			r.Log.Error(err.Error())
+			return
+		}
+		handler(event)
+	})
+	if err != nil {
+		r.Log.Error(err.Error())
+		return nil, err
+	}
+	err = subscription.Subscribe(presenceChannel(user.ID))
+	if err != nil {
+		subscription.Close()
+		r.Log.Error(err.Error())
+		return nil, err
+	}
+	return &PresenceSubscription{subscription: subscription}, nil
+}
+
+func (p *PresenceSubscription) Close() {
+	p.subscription.Close()
+}
@@ -0,0 +1,239 @@
+package twocloud
+
+import (
+	"github.com/fzzbt/radix/redis"
+	"strconv"
+	"time"
+)
+
+const defaultDeviceDormancy = 30
+const defaultDeviceExpiry = 90
+
+type DormantDeviceError struct {
+	Device uint64
+}
+
+func (e *DormantDeviceError) Error() string {
+	return "Device " + strconv.FormatUint(e.Device, 10) + " hasn't been seen in a while, so it can't be sent anything until it's seen again."
+}
+
+// PruneReport lists what a pruning run did, or in a dry run, what it
+// would have done.
+type PruneReport struct {
+	DryRun  bool      `json:"dry_run,omitempty"`
+	Started time.Time `json:"started,omitempty"`
+	Dormant []Device  `json:"dormant,omitempty"`
+	Deleted []Device  `json:"deleted,omitempty"`
+	Failed  int       `json:"failed,omitempty"`
+}
+
+func (r *RequestBundle) deviceDormancy() time.Duration {
+	if r.Config.DeviceDormancy < 1 {
+		return time.Hour * 24 * defaultDeviceDormancy
+	}
+	return time.Hour * 24 * r.Config.DeviceDormancy
+}
+
+func (r *RequestBundle) deviceExpiry() time.Duration {
+	if r.Config.DeviceExpiry < 1 {
+		return time.Hour * 24 * defaultDeviceExpiry
+	}
+	return time.Hour * 24 * r.Config.DeviceExpiry
+}
+
+// activeDevices leaves out dormant devices, which shouldn't be sent
+// anything until they're seen again.
+func activeDevices(devices []Device) []Device {
+	active := []Device{}
+	for _, device := range devices {
+		if !device.Dormant {
+			active = append(active, device)
+		}
+	}
+	return active
+}
+
+// checkReceiversActive fails with a DormantDeviceError naming the first
+// receiver that's dormant, so a batch of links is never sent in part.
+func (r *RequestBundle) checkReceiversActive(links []Link) error {
+	checked := map[uint64]bool{}
+	for _, link := range links {
+		if checked[link.Receiver.ID] {
+			continue
+		}
+		receiver, err := r.GetDevice(link.Receiver.ID)
+		if err != nil {
+			return err
+		}
+		if receiver.Dormant {
+			return &DormantDeviceError{Device: receiver.ID}
+		}
+		checked[link.Receiver.ID] = true
+	}
+	return nil
+}
+
+// eachUserBatch pages through every user, going by the usernames they
+// registered rather than any index that might leave some of them out. A
+// user may come round twice if the hash grows mid-scan, but is never
+// missed.
+func (r *RequestBundle) eachUserBatch(fn func(users []uint64) error) error {
+	size := r.Config.BroadcastBatchSize
+	if size < 1 {
+		size = defaultBroadcastBatchSize
+	}
+	cursor := "0"
+	for {
+		reply := r.Repo.client.Call("HSCAN", "usernames_to_ids", cursor, "COUNT", size)
+		// add repo call to instrumentation
+		if reply.Err != nil {
+			r.Log.Error(reply.Err.Error())
+			return reply.Err
+		}
+		if len(reply.Elems) < 2 {
+			return nil
+		}
+		next, err := reply.Elems[0].Str()
+		if err != nil {
+			r.Log.Error(err.Error())
+			return err
+		}
+		fields, err := reply.Elems[1].List()
+		if err != nil {
+			r.Log.Error(err.Error())
+			return err
+		}
+		seen := map[uint64]bool{}
+		users := []uint64{}
+		for pos := 1; pos < len(fields); pos += 2 {
+			id, err := strconv.ParseUint(fields[pos], 10, 64)
+			if err != nil {
+				r.Log.Error(err.Error())
+				continue
+			}
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			users = append(users, id)
+		}
+		if len(users) > 0 {
+			err = fn(users)
+			if err != nil {
+				return err
+			}
+		}
+		if next == "0" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// PruneStaleDevices goes through every user's devices by last seen time.
+// Devices that haven't been seen within the dormancy threshold are marked
+// dormant, and those that haven't been seen within the expiry threshold are
+// deleted and their user is told. With dryRun set, nothing is changed and
+// the report says what would have happened.
+func (r *RequestBundle) PruneStaleDevices(dryRun bool) (PruneReport, error) {
+	// start instrumentation
+	now := time.Now()
+	report := PruneReport{
+		DryRun:  dryRun,
+		Started: now,
+		Dormant: []Device{},
+		Deleted: []Device{},
+	}
+	dormantBefore := now.Add(-r.deviceDormancy())
+	expiredBefore := now.Add(-r.deviceExpiry())
+	err := r.eachUserBatch(func(users []uint64) error {
+		for _, user := range users {
+			reply := r.Repo.client.Zrangebyscore("users:"+strconv.FormatUint(user, 10)+":devices", "-inf", "("+strconv.FormatInt(dormantBefore.Unix(), 10))
+			// add repo call to instrumentation
+			if reply.Err != nil {
+				r.Log.Error(reply.Err.Error())
+				report.Failed++
+				continue
+			}
+			if reply.Type == redis.ReplyNil {
+				continue
+			}
+			ids, err := reply.List()
+			if err != nil {
+				r.Log.Error(err.Error())
+				report.Failed++
+				continue
+			}
+			for _, idstr := range ids {
+				id, err := strconv.ParseUint(idstr, 10, 64)
+				if err != nil {
+					r.Log.Error(err.Error())
+					continue
+				}
+				device, err := r.GetDevice(id)
+				if err != nil {
+					report.Failed++
+					continue
+				}
+				if device.LastSeen.Before(expiredBefore) {
+					if !dryRun {
+						err = r.pruneDevice(device)
+						if err != nil {
+							report.Failed++
+							continue
+						}
+					}
+					report.Deleted = append(report.Deleted, device)
+				} else if !device.Dormant {
+					if !dryRun {
+						err = r.markDeviceDormant(device)
+						if err != nil {
+							report.Failed++
+							continue
+						}
+						device.Dormant = true
+					}
+					report.Dormant = append(report.Dormant, device)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	// stop instrumentation
+	return report, nil
+}
+
+func (r *RequestBundle) markDeviceDormant(device Device) error {
+	reply := r.Repo.client.Hset("devices:"+strconv.FormatUint(device.ID, 10), "dormant", boolString(true))
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return reply.Err
+	}
+	r.Audit("devices:"+strconv.FormatUint(device.ID, 10), "dormant", boolString(false), boolString(true))
+	// add repo call to instrumentation
+	return nil
+}
+
+func (r *RequestBundle) pruneDevice(device Device) error {
+	err := r.DeleteDevice(device)
+	if err != nil {
+		return err
+	}
+	notification := Notification{
+		Nature: "device_pruned",
+		Params: map[string]string{
+			"device":         device.Name,
+			"last_seen":      device.LastSeen.Format(time.RFC3339),
+			"last_seen_date": device.LastSeen.Format("January 2, 2006"),
+		},
+	}
+	_, err = r.SendNotificationsToUser(User{ID: device.UserID}, []Notification{notification})
+	if err != nil {
+		r.Log.Error(err.Error())
+	}
+	return nil
+}
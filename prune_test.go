@@ -0,0 +1,43 @@
+package twocloud
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestAddLinksRejectsBatchWithDormantReceiver(t *testing.T) {
+	r, server := testBundle(t)
+	testDevice(t, r, "1", "10")
+	testDevice(t, r, "2", "20")
+	testDevice(t, r, "3", "20")
+	server.HSet("devices:3", "dormant", "1")
+	_, err := r.AddLinks([]Link{testLink(0, 0, 1, 2), testLink(0, 0, 1, 3)})
+	dormant, ok := err.(*DormantDeviceError)
+	if !ok {
+		t.Fatalf("Expected a DormantDeviceError, got %v.", err)
+	}
+	if dormant.Device != 3 {
+		t.Errorf("Expected the error to name device 3, got %d.", dormant.Device)
+	}
+	assertNoKeys(t, server, "urls_to_ids", "devices:2:links:received", "devices:3:links:received")
+}
+
+func TestPruneStaleDevicesPagesThroughEveryUser(t *testing.T) {
+	r, _ := testBundle(t)
+	r.Config.BroadcastBatchSize = 1
+	for id := 10; id < 15; id++ {
+		user := strconv.Itoa(id)
+		testUser(t, r, user, "en")
+		testDevice(t, r, strconv.Itoa(id+10), user)
+	}
+	report, err := r.PruneStaleDevices(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Deleted) != 5 {
+		t.Errorf("Expected 5 devices to be pruned, got %d.", len(report.Deleted))
+	}
+	if report.Failed != 0 {
+		t.Errorf("Expected no failures, got %d.", report.Failed)
+	}
+}
@@ -0,0 +1,168 @@
+package twocloud
+
+import (
+	"sync"
+)
+
+const defaultPushWorkers = 8
+const defaultPushQueueSize = 1000
+
+// PushQueue runs pushes in the background, so senders don't wait on push
+// servers that are slow or backing off between retries.
+type PushQueue struct {
+	jobs chan func()
+	wait sync.WaitGroup
+}
+
+func NewPushQueue(workers, size int) *PushQueue {
+	if workers < 1 {
+		workers = defaultPushWorkers
+	}
+	if size < 1 {
+		size = defaultPushQueueSize
+	}
+	queue := &PushQueue{
+		jobs: make(chan func(), size),
+	}
+	for i := 0; i < workers; i++ {
+		queue.wait.Add(1)
+		go func() {
+			defer queue.wait.Done()
+			for job := range queue.jobs {
+				job()
+			}
+		}()
+	}
+	return queue
+}
+
+// Close waits for the pushes already queued to finish.
+func (q *PushQueue) Close() {
+	close(q.jobs)
+	q.wait.Wait()
+}
+
+func (q *PushQueue) add(job func()) bool {
+	select {
+	case q.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// defaultPushQueue is shared by bundles that haven't been given a push
+// queue, so pushes are still bounded. It's started the first time it's
+// needed.
+var defaultPushQueue *PushQueue
+var defaultPushQueueOnce sync.Once
+
+func (r *RequestBundle) pushQueue() *PushQueue {
+	if r.Pushes != nil {
+		return r.Pushes
+	}
+	defaultPushQueueOnce.Do(func() {
+		defaultPushQueue = NewPushQueue(defaultPushWorkers, defaultPushQueueSize)
+	})
+	return defaultPushQueue
+}
+
+// pushLater runs push on a copy of the bundle once a worker is free. The
+// copy doesn't keep the request, which is finished with by the time the
+// push runs. When the queue is full the push is dropped; notification
+// deliveries stay queued for the device to collect when it next connects.
+func (r *RequestBundle) pushLater(push func(r *RequestBundle)) {
+	bundle := *r
+	bundle.Request = nil
+	if !r.pushQueue().add(func() { push(&bundle) }) {
+		r.Log.Warn("Push queue is full, dropping a push.")
+	}
+}
+
+func (r *RequestBundle) pushNotifications(notifications []Notification, devices []Device) {
+	deliveries, err := r.queueDeliveries(notifications, devices)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return
+	}
+	// the caller keeps its slice, so the pushes get their own copy
+	notifications = copyNotifications(notifications)
+	r.pushLater(func(r *RequestBundle) {
+		r.sendDeliveries(deliveries, notifications, devices)
+	})
+}
+
+func (r *RequestBundle) sendDeliveries(deliveries []Delivery, notifications []Notification, devices []Device) {
+	byID := map[uint64]Notification{}
+	for _, notification := range notifications {
+		byID[notification.ID] = notification
+	}
+	byDevice := map[uint64]Device{}
+	for _, device := range devices {
+		byDevice[device.ID] = device
+	}
+	for _, delivery := range deliveries {
+		notification := byID[delivery.Notification]
+		sent, err := r.pushEvent(byDevice[delivery.Device], delivery.Pusher, PushEvent{
+			Type:         "notification",
+			ID:           notification.ID,
+			Delivery:     delivery.ID,
+			Notification: &notification,
+		})
+		// the device can't be reached right now, so leave the delivery
+		// queued for it to pick up when it reconnects
+		if err == nil && !sent {
+			continue
+		}
+		status, detail := DeliverySent, ""
+		if err != nil {
+			status, detail = DeliveryFailed, err.Error()
+		}
+		_, err = r.UpdateDeliveryStatus(delivery, status, detail)
+		if err != nil {
+			r.Log.Error(err.Error())
+		}
+	}
+}
+
+func (r *RequestBundle) pushLinks(links []Link) {
+	r.pushLater(func(r *RequestBundle) {
+		r.sendLinks(links)
+	})
+}
+
+func (r *RequestBundle) sendLinks(links []Link) {
+	for _, link := range links {
+		if link.Receiver.Pushers == nil {
+			receiver, err := r.GetDevice(link.Receiver.ID)
+			if err != nil {
+				r.Log.Error(err.Error())
+				continue
+			}
+			link.Receiver = receiver
+		}
+		// the event goes to the receiver, who has no need of either
+		// device's push registrations
+		pushed := link
+		pushed.Sender.Pushers = nil
+		pushed.Receiver.Pushers = nil
+		for _, pusher := range r.devicePushers(link.Receiver) {
+			sent, err := r.pushEvent(link.Receiver, pusher, PushEvent{
+				Type: "link",
+				ID:   link.ID,
+				Link: &pushed,
+			})
+			if err != nil {
+				r.Log.Error(err.Error())
+				continue
+			}
+			if !sent {
+				continue
+			}
+			err = r.UpdateDevicePusherLastUsed(link.Receiver, pusher)
+			if err != nil {
+				r.Log.Error(err.Error())
+			}
+		}
+	}
+}
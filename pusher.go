@@ -0,0 +1,455 @@
+package twocloud
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const PusherWebhook = "webhook"
+
+// PushTransport is a way of getting push events to a device. Each device
+// keeps its own Pusher for every transport it has signed up for, holding
+// whatever key and config that transport needs.
+type PushTransport interface {
+	Name() string
+	// Validate checks a pusher's key and config before it's stored.
+	Validate(pusher *Pusher) error
+	// Available reports whether a device's pusher can currently be used.
+	Available(pusher *Pusher) bool
+	// Push sends an event to the device. It reports false without an
+	// error when the device can't be reached right now and the event
+	// should stay queued for it.
+	Push(r *RequestBundle, device Device, pusher *Pusher, event PushEvent) (bool, error)
+}
+
+var InvalidPusherConfigError = errors.New("The pusher's configuration is invalid.")
+var PusherNotFoundError = errors.New("The device doesn't have that pusher.")
+
+type PusherRegistry struct {
+	transports map[string]PushTransport
+	lock       sync.RWMutex
+}
+
+func NewPusherRegistry(transports ...PushTransport) *PusherRegistry {
+	registry := &PusherRegistry{
+		transports: map[string]PushTransport{},
+	}
+	for _, transport := range transports {
+		registry.Register(transport)
+	}
+	return registry
+}
+
+var defaultPusherRegistry = NewPusherRegistry(
+	GCMTransport{},
+	ChannelTransport{name: PusherWebSockets},
+	ChannelTransport{name: PusherSSE},
+	WebhookTransport{},
+)
+
+func (p *PusherRegistry) Register(transport PushTransport) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.transports[transport.Name()] = transport
+}
+
+func (p *PusherRegistry) Get(name string) (PushTransport, bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	transport, exists := p.transports[name]
+	return transport, exists
+}
+
+func (p *PusherRegistry) Names() []string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	names := []string{}
+	for name, _ := range p.transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (r *RequestBundle) pusherRegistry() *PusherRegistry {
+	if r.PushTransports != nil {
+		return r.PushTransports
+	}
+	return defaultPusherRegistry
+}
+
+// pushersFromHash reads each registered pusher out of a device hash. A
+// pusher's fields are stored as <name>_key, <name>_last_used,
+// <name>_invalid and <name>_config, and a device has a pusher when any of
+// them is set.
+func (r *RequestBundle) pushersFromHash(hash map[string]string) (Pushers, error) {
+	pushers := Pushers{}
+	for _, name := range r.pusherRegistry().Names() {
+		key, hasKey := hash[name+"_key"]
+		lastUsed, hasLastUsed := hash[name+"_last_used"]
+		config, hasConfig := hash[name+"_config"]
+		if !hasKey && !hasLastUsed && !hasConfig {
+			continue
+		}
+		pusher := &Pusher{
+			Key:     key,
+			Invalid: hash[name+"_invalid"] == "1",
+		}
+		if lastUsed != "" {
+			var err error
+			pusher.LastUsed, err = time.Parse(time.RFC3339, lastUsed)
+			if err != nil {
+				return Pushers{}, err
+			}
+		}
+		if config != "" {
+			err := json.Unmarshal([]byte(config), &pusher.Config)
+			if err != nil {
+				return Pushers{}, err
+			}
+		}
+		pushers[name] = pusher
+	}
+	return pushers, nil
+}
+
+func pusherHash(name string, pusher *Pusher) (map[string]interface{}, error) {
+	hash := map[string]interface{}{
+		name + "_key":     pusher.Key,
+		name + "_invalid": boolString(pusher.Invalid),
+		name + "_config":  "",
+	}
+	if len(pusher.Config) > 0 {
+		config, err := json.Marshal(pusher.Config)
+		if err != nil {
+			return nil, err
+		}
+		hash[name+"_config"] = string(config)
+	}
+	return hash, nil
+}
+
+func (r *RequestBundle) SetDevicePusher(device Device, name string, pusher Pusher) (Device, error) {
+	// start instrumentation
+	transport, exists := r.pusherRegistry().Get(name)
+	if !exists {
+		return Device{}, InvalidPusherType
+	}
+	pusher.Invalid = false
+	err := transport.Validate(&pusher)
+	if err != nil {
+		return Device{}, err
+	}
+	changes, err := pusherHash(name, &pusher)
+	if err != nil {
+		return Device{}, err
+	}
+	from := map[string]interface{}{
+		name + "_key":     "",
+		name + "_invalid": "",
+		name + "_config":  "",
+	}
+	if old, exists := device.Pushers[name]; exists {
+		pusher.LastUsed = old.LastUsed
+		from, err = pusherHash(name, old)
+		if err != nil {
+			return Device{}, err
+		}
+	}
+	reply := r.Repo.client.Hmset("devices:"+strconv.FormatUint(device.ID, 10), changes)
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return Device{}, reply.Err
+	}
+	r.AuditMap("devices:"+strconv.FormatUint(device.ID, 10), from, changes)
+	// add repo call to instrumentation
+	if device.Pushers == nil {
+		device.Pushers = Pushers{}
+	}
+	device.Pushers[name] = &pusher
+	// stop instrumentation
+	return device, nil
+}
+
+func (r *RequestBundle) RemoveDevicePusher(device Device, name string) (Device, error) {
+	// start instrumentation
+	old, exists := device.Pushers[name]
+	if !exists {
+		return Device{}, PusherNotFoundError
+	}
+	from, err := pusherHash(name, old)
+	if err != nil {
+		return Device{}, err
+	}
+	to := map[string]interface{}{}
+	for field, _ := range from {
+		to[field] = ""
+	}
+	reply := r.Repo.client.Hdel("devices:"+strconv.FormatUint(device.ID, 10), name+"_key", name+"_invalid", name+"_config", name+"_last_used")
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return Device{}, reply.Err
+	}
+	r.AuditMap("devices:"+strconv.FormatUint(device.ID, 10), from, to)
+	// add repo call to instrumentation
+	delete(device.Pushers, name)
+	// stop instrumentation
+	return device, nil
+}
+
+type GCMTransport struct{}
+
+func (g GCMTransport) Name() string {
+	return PusherGCM
+}
+
+func (g GCMTransport) Validate(pusher *Pusher) error {
+	pusher.Key = strings.TrimSpace(pusher.Key)
+	if pusher.Key == "" {
+		return InvalidPusherConfigError
+	}
+	return nil
+}
+
+func (g GCMTransport) Available(pusher *Pusher) bool {
+	return pusher.Key != "" && !pusher.Invalid
+}
+
+func (g GCMTransport) Push(r *RequestBundle, device Device, pusher *Pusher, event PushEvent) (bool, error) {
+	if r.GCM == nil {
+		return false, nil
+	}
+	message := GCMMessage{}
+	if event.Link != nil {
+		message = linkGCMMessage(*event.Link)
+	} else if event.Notification != nil {
+		message = notificationGCMMessage(*event.Notification)
+	}
+	_, err := r.pushGCM(device, message)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ChannelTransport publishes events on the device's Redis channel for a
+// connection-based transport, like WebSockets or server-sent events, to
+// relay to whichever node the device is connected to.
+type ChannelTransport struct {
+	name string
+}
+
+func (c ChannelTransport) Name() string {
+	return c.name
+}
+
+func (c ChannelTransport) Validate(pusher *Pusher) error {
+	return nil
+}
+
+func (c ChannelTransport) Available(pusher *Pusher) bool {
+	return true
+}
+
+func (c ChannelTransport) Push(r *RequestBundle, device Device, pusher *Pusher, event PushEvent) (bool, error) {
+	receivers, err := r.publishPushEvent(c.name, device.ID, event)
+	if err != nil {
+		return false, err
+	}
+	return receivers > 0, nil
+}
+
+type WebhookError struct {
+	StatusCode int
+}
+
+func (e *WebhookError) Error() string {
+	return "The webhook responded with status " + strconv.Itoa(e.StatusCode) + "."
+}
+
+var WebhookAddressError = errors.New("Webhooks can't be sent to private, loopback or link-local addresses.")
+
+const webhookTimeout = time.Second * 10
+
+// blockedWebhookNetworks are the addresses a webhook could use to reach
+// this server's own network rather than the device's owner.
+var blockedWebhookNetworks = parseNetworks(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func webhookAddressAllowed(ip net.IP) bool {
+	for _, network := range blockedWebhookNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialWebhook only connects to addresses webhooks are allowed to reach. It
+// checks the addresses the host resolves to when the connection is made,
+// as well as when the pusher was validated, so a host can't be pointed at
+// the internal network later.
+func dialWebhook(network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	err = WebhookAddressError
+	for _, ip := range ips {
+		if !webhookAddressAllowed(ip) {
+			continue
+		}
+		conn, dialErr := net.DialTimeout(network, net.JoinHostPort(ip.String(), port), webhookTimeout)
+		if dialErr == nil {
+			return conn, nil
+		}
+		err = dialErr
+	}
+	return nil, err
+}
+
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		Dial: dialWebhook,
+	},
+}
+
+// WebhookTransport POSTs each event as JSON to the URL in the pusher's
+// config. When the config also has a secret, the body is signed with
+// HMAC-SHA256 in the X-2cloud-Signature header. Unless a client is set,
+// webhooks are never sent to private, loopback or link-local addresses.
+type WebhookTransport struct {
+	Client *http.Client
+}
+
+func (w WebhookTransport) Name() string {
+	return PusherWebhook
+}
+
+func (w WebhookTransport) Validate(pusher *Pusher) error {
+	parsed, err := url.Parse(pusher.Config["url"])
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return InvalidPusherConfigError
+	}
+	host := parsed.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) < 1 {
+		return InvalidPusherConfigError
+	}
+	for _, ip := range ips {
+		if !webhookAddressAllowed(ip) {
+			return WebhookAddressError
+		}
+	}
+	return nil
+}
+
+func (w WebhookTransport) Available(pusher *Pusher) bool {
+	return pusher.Config["url"] != "" && !pusher.Invalid
+}
+
+func (w WebhookTransport) Push(r *RequestBundle, device Device, pusher *Pusher, event PushEvent) (bool, error) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest("POST", pusher.Config["url"], bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret := pusher.Config["secret"]; secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set("X-2cloud-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+	client := w.Client
+	if client == nil {
+		client = webhookClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return false, &WebhookError{StatusCode: resp.StatusCode}
+	}
+	return true, nil
+}
+
+func (r *RequestBundle) pushEvent(device Device, name string, event PushEvent) (bool, error) {
+	transport, exists := r.pusherRegistry().Get(name)
+	if !exists {
+		return false, InvalidPusherType
+	}
+	pusher, exists := device.Pushers[name]
+	if !exists || !transport.Available(pusher) {
+		return false, PusherNotFoundError
+	}
+	return transport.Push(r, device, pusher, r.localizeEvent(device, event))
+}
+
+// localizeEvent renders the templated notification an event carries in the
+// locale of the device's user, however the event reaches the device.
+func (r *RequestBundle) localizeEvent(device Device, event PushEvent) PushEvent {
+	if event.Notification == nil || !event.Notification.Templated {
+		return event
+	}
+	localized := r.localizeNotification(*event.Notification, r.getUserLocale(device.UserID))
+	event.Notification = &localized
+	return event
+}
+
+// devicePushers lists the pushers a device can be reached through right now.
+func (r *RequestBundle) devicePushers(device Device) []string {
+	pushers := []string{}
+	for _, name := range r.pusherRegistry().Names() {
+		pusher, exists := device.Pushers[name]
+		if !exists {
+			continue
+		}
+		transport, _ := r.pusherRegistry().Get(name)
+		if transport.Available(pusher) {
+			pushers = append(pushers, name)
+		}
+	}
+	return pushers
+}
@@ -17,3 +17,10 @@ func NewRadix(conf redis.Config) *Radix {
 func (r *Radix) Close() {
 	r.client.Close()
 }
+
+func boolString(value bool) string {
+	if value {
+		return "1"
+	}
+	return "0"
+}
@@ -0,0 +1,263 @@
+package twocloud
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/PuerkitoBio/purell"
+	"github.com/fzzbt/radix/redis"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Verdict string
+
+const (
+	VerdictSafe     = Verdict("safe")
+	VerdictPhishing = Verdict("phishing")
+	VerdictMalware  = Verdict("malware")
+	VerdictUnwanted = Verdict("unwanted")
+)
+
+type ScreeningAction string
+
+const (
+	ScreeningAllow = ScreeningAction("allow")
+	ScreeningBlock = ScreeningAction("block")
+	ScreeningWarn  = ScreeningAction("warn")
+	ScreeningFlag  = ScreeningAction("flag")
+)
+
+type URLScreener interface {
+	Screen(address string) (Verdict, error)
+}
+
+type URLBlockedError struct {
+	Address string
+	Verdict Verdict
+}
+
+func (e *URLBlockedError) Error() string {
+	return "The URL " + e.Address + " was blocked because it was identified as " + string(e.Verdict) + "."
+}
+
+type blocklistEntry struct {
+	value   string
+	verdict Verdict
+}
+
+type Blocklist struct {
+	domains  map[string]Verdict
+	prefixes []blocklistEntry
+	hashes   []blocklistEntry
+}
+
+// LoadBlocklist reads a blocklist file. Each line holds a list type (domain,
+// prefix or hash), a verdict and a value, separated by whitespace. Hash
+// values are hex prefixes of the SHA-256 of the normalized URL or its host.
+// Blank lines and lines starting with # are ignored.
+func LoadBlocklist(path string) (*Blocklist, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	list := &Blocklist{
+		domains:  map[string]Verdict{},
+		prefixes: []blocklistEntry{},
+		hashes:   []blocklistEntry{},
+	}
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, BlocklistSyntaxError{Line: line}
+		}
+		verdict := Verdict(fields[1])
+		switch fields[0] {
+		case "domain":
+			list.domains[strings.ToLower(fields[2])] = verdict
+		case "prefix":
+			list.prefixes = append(list.prefixes, blocklistEntry{value: fields[2], verdict: verdict})
+		case "hash":
+			list.hashes = append(list.hashes, blocklistEntry{value: strings.ToLower(fields[2]), verdict: verdict})
+		default:
+			return nil, BlocklistSyntaxError{Line: line}
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+type BlocklistSyntaxError struct {
+	Line int
+}
+
+func (e BlocklistSyntaxError) Error() string {
+	return "Invalid blocklist entry on line " + strconv.Itoa(e.Line) + "."
+}
+
+func (b *Blocklist) Screen(address string) (Verdict, error) {
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return "", err
+	}
+	host := strings.ToLower(parsed.Host)
+	if colon := strings.LastIndex(host, ":"); colon >= 0 {
+		host = host[:colon]
+	}
+	for domain := host; domain != ""; {
+		if verdict, found := b.domains[domain]; found {
+			return verdict, nil
+		}
+		dot := strings.Index(domain, ".")
+		if dot < 0 {
+			break
+		}
+		domain = domain[dot+1:]
+	}
+	for _, entry := range b.prefixes {
+		if strings.HasPrefix(address, entry.value) {
+			return entry.verdict, nil
+		}
+	}
+	urlSum := sha256.Sum256([]byte(address))
+	hostSum := sha256.Sum256([]byte(host))
+	urlHash := hex.EncodeToString(urlSum[:])
+	hostHash := hex.EncodeToString(hostSum[:])
+	for _, entry := range b.hashes {
+		if strings.HasPrefix(urlHash, entry.value) || strings.HasPrefix(hostHash, entry.value) {
+			return entry.verdict, nil
+		}
+	}
+	return VerdictSafe, nil
+}
+
+// LoadScreener screens links against the blocklist file named in the
+// configuration, unless a screener has already been set. It should be run
+// on the base bundle when the process starts.
+func (r *RequestBundle) LoadScreener() error {
+	if r.Screener != nil || r.Config.Screening.Blocklist == "" {
+		return nil
+	}
+	list, err := LoadBlocklist(r.Config.Screening.Blocklist)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return err
+	}
+	r.Screener = list
+	return nil
+}
+
+func (r *RequestBundle) screeningAction(verdict Verdict) ScreeningAction {
+	if verdict == VerdictSafe || verdict == "" {
+		return ScreeningAllow
+	}
+	if action, set := r.Config.Screening.Actions[verdict]; set {
+		return action
+	}
+	return ScreeningBlock
+}
+
+func (r *RequestBundle) screenURL(u *URL) (Verdict, error) {
+	// start instrumentation
+	address, err := purell.NormalizeURLString(u.Address, purell.FlagsSafe)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return "", err
+	}
+	cached, screened, err := r.getCachedVerdict(address)
+	if err != nil {
+		return "", err
+	}
+	ttl := time.Second * r.Config.Screening.CacheTTL
+	if cached != "" && time.Now().Before(screened.Add(ttl)) {
+		u.Verdict = cached
+		u.Screened = screened
+		return cached, nil
+	}
+	verdict, err := r.Screener.Screen(address)
+	// add screener call to instrumentation
+	if err != nil {
+		r.Log.Error(err.Error())
+		return "", err
+	}
+	u.Verdict = verdict
+	u.Screened = time.Now()
+	// stop instrumentation
+	return verdict, nil
+}
+
+func (r *RequestBundle) getCachedVerdict(address string) (Verdict, time.Time, error) {
+	reply := r.Repo.client.Hget("urls_to_ids", address)
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return "", time.Time{}, reply.Err
+	}
+	if reply.Type == redis.ReplyNil {
+		return "", time.Time{}, nil
+	}
+	id, err := reply.Str()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return "", time.Time{}, err
+	}
+	reply = r.Repo.client.Hmget("urls:"+id, "verdict", "screened")
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return "", time.Time{}, reply.Err
+	}
+	if len(reply.Elems) != 2 || reply.Elems[0].Type == redis.ReplyNil || reply.Elems[1].Type == redis.ReplyNil {
+		return "", time.Time{}, nil
+	}
+	verdict, err := reply.Elems[0].Str()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return "", time.Time{}, err
+	}
+	screenedstr, err := reply.Elems[1].Str()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return "", time.Time{}, err
+	}
+	screened, err := time.Parse(time.RFC3339, screenedstr)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return "", time.Time{}, err
+	}
+	return Verdict(verdict), screened, nil
+}
+
+func (r *RequestBundle) flagLinks(links []Link) error {
+	// start instrumentation
+	reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		for _, link := range links {
+			mc.Zadd("flagged_links", time.Now().Unix(), link.ID)
+		}
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return reply.Err
+	}
+	for _, link := range links {
+		r.Audit("flagged_links", strconv.FormatUint(link.ID, 10), "", string(link.URL.Verdict))
+	}
+	// add repo calls to instrumentation
+	// stop instrumentation
+	return nil
+}
@@ -0,0 +1,258 @@
+package twocloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fzzbt/radix/redis"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultSSEHeartbeat = 15
+const maxSSEResumeEvents = 100
+
+type pushEvents []PushEvent
+
+func (e pushEvents) Len() int           { return len(e) }
+func (e pushEvents) Less(i, j int) bool { return e[i].ID < e[j].ID }
+func (e pushEvents) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+func (h *Hub) SSEHandler() http.Handler {
+	return http.HandlerFunc(h.serveSSE)
+}
+
+func writeSSEEvent(w http.ResponseWriter, id uint64, kind string, data []byte) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, kind, data)
+	return err
+}
+
+// serveSSE streams a device's push events as server-sent events. IDs are
+// link and notification IDs, which increase over time, so a client that
+// reconnects with a Last-Event-ID is caught up from the device's link and
+// notification lists. Either way, notifications still queued for SSE are
+// replayed before live events resume.
+func (h *Hub) serveSSE(w http.ResponseWriter, req *http.Request) {
+	user, device, err := h.authenticate(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported.", http.StatusInternalServerError)
+		return
+	}
+	done := make(chan bool)
+	var once sync.Once
+	conn := &hubConn{
+		device:  device,
+		channel: pushChannel(PusherSSE, device.ID),
+		send:    make(chan []byte, hubSendBuffer),
+		close: func() {
+			once.Do(func() {
+				close(done)
+			})
+		},
+	}
+	err = h.register(conn)
+	if err != nil {
+		h.base.Log.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer h.unregister(conn)
+	r := h.bundle(req, user, device)
+	err = r.UpdateDeviceSSELastUsed(device)
+	if err != nil {
+		r.Log.Error(err.Error())
+	}
+	stop := make(chan bool)
+	defer close(stop)
+	go r.heartbeatPresence(device, stop)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	lastID := strings.TrimSpace(req.Header.Get("Last-Event-ID"))
+	if lastID == "" {
+		lastID = req.URL.Query().Get("last_event_id")
+	}
+	resumed := map[uint64]bool{}
+	if lastID != "" {
+		after, err := strconv.ParseUint(lastID, 10, 64)
+		if err == nil {
+			resumed, err = r.resumeSSE(w, flusher, device, after)
+			if err != nil {
+				return
+			}
+		}
+	}
+	r.replayQueuedDeliveries(device, PusherSSE, resumed)
+	var closed <-chan bool
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		closed = notifier.CloseNotify()
+	}
+	interval := r.Config.SSEHeartbeat
+	if interval < 1 {
+		interval = defaultSSEHeartbeat
+	}
+	heartbeat := time.NewTicker(time.Second * interval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case payload, ok := <-conn.send:
+			if !ok {
+				return
+			}
+			var event PushEvent
+			err = json.Unmarshal(payload, &event)
+			if err != nil {
+				r.Log.Error(err.Error())
+				continue
+			}
+			err = writeSSEEvent(w, event.ID, event.Type, payload)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-closed:
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// resumeSSE writes every event the device missed after the event with the
+// given ID, a page at a time, and returns the notifications it wrote.
+func (r *RequestBundle) resumeSSE(w http.ResponseWriter, flusher http.Flusher, device Device, after uint64) (map[uint64]bool, error) {
+	written := map[uint64]bool{}
+	for {
+		events, next, err := r.getPushEventsSince(device, after)
+		if err != nil {
+			r.Log.Error(err.Error())
+			return written, nil
+		}
+		for _, event := range events {
+			data, err := json.Marshal(r.localizeEvent(device, event))
+			if err != nil {
+				r.Log.Error(err.Error())
+				continue
+			}
+			err = writeSSEEvent(w, event.ID, event.Type, data)
+			if err != nil {
+				return written, err
+			}
+			if event.Notification != nil {
+				written[event.ID] = true
+			}
+		}
+		flusher.Flush()
+		if next == 0 {
+			return written, nil
+		}
+		after = next
+	}
+}
+
+type uint64s []uint64
+
+func (u uint64s) Len() int           { return len(u) }
+func (u uint64s) Less(i, j int) bool { return u[i] < u[j] }
+func (u uint64s) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+
+// resumePageEnd returns the last ID in the oldest page of count IDs in the
+// list at key that come after after, or 0 if they all fit in one page.
+func (r *RequestBundle) resumePageEnd(key string, after uint64, count int) (uint64, error) {
+	reply := r.Repo.client.Lrange(key, 0, -1)
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return 0, reply.Err
+	}
+	if reply.Type == redis.ReplyNil {
+		return 0, nil
+	}
+	list, err := reply.List()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return 0, err
+	}
+	ids := uint64s{}
+	for _, idstr := range list {
+		id, err := strconv.ParseUint(idstr, 10, 64)
+		if err != nil || id <= after {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) <= count {
+		return 0, nil
+	}
+	sort.Sort(ids)
+	return ids[count-1], nil
+}
+
+// getPushEventsSince rebuilds the oldest page of events a device missed
+// after the event with the given ID: the links it received and the
+// notifications addressed to it or to its user, oldest first. It also
+// returns the ID to continue from, or 0 once the device is caught up.
+func (r *RequestBundle) getPushEventsSince(device Device, after uint64) ([]PushEvent, uint64, error) {
+	events := pushEvents{}
+	linksKey := "devices:" + strconv.FormatUint(device.ID, 10) + ":links:received"
+	notificationsKey := "users:" + strconv.FormatUint(device.UserID, 10) + ":notifications"
+	// both lists are read up to the end of whichever page ends first, so
+	// the events stay in order across pages
+	next := uint64(0)
+	for _, key := range []string{linksKey, notificationsKey} {
+		end, err := r.resumePageEnd(key, after, maxSSEResumeEvents)
+		if err != nil {
+			return []PushEvent{}, 0, err
+		}
+		if end != 0 && (next == 0 || end < next) {
+			next = end
+		}
+	}
+	before := uint64(0)
+	if next != 0 {
+		before = next + 1
+	}
+	links, err := r.getLinksByKey(linksKey, before, after, 0)
+	if err != nil {
+		return []PushEvent{}, 0, err
+	}
+	for pos, _ := range links {
+		events = append(events, PushEvent{
+			Type: "link",
+			ID:   links[pos].ID,
+			Link: &links[pos],
+		})
+	}
+	notifications, err := r.getNotificationsByKey(notificationsKey, before, after, 0)
+	if err != nil {
+		return []PushEvent{}, 0, err
+	}
+	for pos, notification := range notifications {
+		if notification.DestinationType == "device" && notification.Destination != device.ID {
+			continue
+		}
+		events = append(events, PushEvent{
+			Type:         "notification",
+			ID:           notification.ID,
+			Notification: &notifications[pos],
+		})
+	}
+	sort.Sort(events)
+	return events, next, nil
+}
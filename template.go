@@ -0,0 +1,253 @@
+package twocloud
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+type NotificationTemplate struct {
+	Nature  string            `json:"nature"`
+	Params  []string          `json:"params,omitempty"`
+	Locales map[string]string `json:"locales"`
+}
+
+var TemplateNotFoundError = errors.New("No template is registered for that notification nature.")
+var InvalidTemplateError = errors.New("A template must have a nature and at least one locale.")
+
+type MissingTemplateLocaleError struct {
+	Nature string
+	Locale string
+}
+
+func (e *MissingTemplateLocaleError) Error() string {
+	return "The " + e.Nature + " template has no variant for " + e.Locale + " or the default locale."
+}
+
+type MissingTemplateParamError struct {
+	Nature string
+	Param  string
+}
+
+func (e *MissingTemplateParamError) Error() string {
+	return "The " + e.Nature + " template requires the " + e.Param + " parameter."
+}
+
+// builtinLocale is the language the built-in templates are written in, and
+// the last one tried when rendering.
+const builtinLocale = "en"
+
+// builtinTemplates are registered with every template registry, so the
+// notifications the server sends on its own can always be rendered.
+var builtinTemplates = []NotificationTemplate{
+	NotificationTemplate{
+		Nature:  "device_paired",
+		Params:  []string{"device"},
+		Locales: map[string]string{builtinLocale: "\"{device}\" was added to your account."},
+	},
+	NotificationTemplate{
+		Nature:  "device_pruned",
+		Params:  []string{"device", "last_seen_date"},
+		Locales: map[string]string{builtinLocale: "Your device \"{device}\" hadn't been seen since {last_seen_date}, so it was removed from your account."},
+	},
+	NotificationTemplate{
+		Nature:  "link_reply",
+		Params:  []string{"reply"},
+		Locales: map[string]string{builtinLocale: "New reply to your link: {reply}"},
+	},
+}
+
+// defaultTemplateRegistry is used by bundles that haven't been given a
+// registry of their own.
+var defaultTemplateRegistry = NewTemplateRegistry("")
+
+type TemplateRegistry struct {
+	DefaultLocale string
+	templates     map[string]NotificationTemplate
+	lock          sync.RWMutex
+}
+
+func NewTemplateRegistry(defaultLocale string) *TemplateRegistry {
+	if defaultLocale == "" {
+		defaultLocale = "en"
+	}
+	registry := &TemplateRegistry{
+		DefaultLocale: defaultLocale,
+		templates:     map[string]NotificationTemplate{},
+	}
+	for _, template := range builtinTemplates {
+		registry.Register(template)
+	}
+	return registry
+}
+
+func (t *TemplateRegistry) Register(template NotificationTemplate) error {
+	if template.Nature == "" || len(template.Locales) < 1 {
+		return InvalidTemplateError
+	}
+	locales := map[string]string{}
+	for locale, body := range template.Locales {
+		locales[normalizeLocale(locale)] = body
+	}
+	template.Locales = locales
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.templates[template.Nature] = template
+	return nil
+}
+
+func (t *TemplateRegistry) Has(nature string) bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	_, exists := t.templates[nature]
+	return exists
+}
+
+// LoadFile registers every template in a JSON file holding an array of
+// templates.
+func (t *TemplateRegistry) LoadFile(path string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	templates := []NotificationTemplate{}
+	err = json.Unmarshal(contents, &templates)
+	if err != nil {
+		return err
+	}
+	for _, template := range templates {
+		err = t.Register(template)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *TemplateRegistry) LoadDir(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		err = t.LoadFile(path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(locale), "_", "-", -1))
+}
+
+// Render fills in a template's {param} placeholders using the variant for
+// locale, falling back to its base language, the default locale and then
+// the built-in locale.
+func (t *TemplateRegistry) Render(nature, locale string, params map[string]string) (string, error) {
+	t.lock.RLock()
+	template, exists := t.templates[nature]
+	t.lock.RUnlock()
+	if !exists {
+		return "", TemplateNotFoundError
+	}
+	candidates := []string{normalizeLocale(locale)}
+	if dash := strings.Index(candidates[0], "-"); dash > 0 {
+		candidates = append(candidates, candidates[0][:dash])
+	}
+	candidates = append(candidates, normalizeLocale(t.DefaultLocale), builtinLocale)
+	body, found := "", false
+	for _, candidate := range candidates {
+		if body, found = template.Locales[candidate]; found {
+			break
+		}
+	}
+	if !found {
+		return "", &MissingTemplateLocaleError{Nature: nature, Locale: locale}
+	}
+	for _, param := range template.Params {
+		value, set := params[param]
+		if !set {
+			return "", &MissingTemplateParamError{Nature: nature, Param: param}
+		}
+		body = strings.Replace(body, "{"+param+"}", value, -1)
+	}
+	return body, nil
+}
+
+func (r *RequestBundle) templates() *TemplateRegistry {
+	if r.Templates != nil {
+		return r.Templates
+	}
+	return defaultTemplateRegistry
+}
+
+func (r *RequestBundle) getUserLocale(user uint64) string {
+	accounts, err := r.GetAccountsByUser(User{ID: user})
+	if err != nil {
+		r.Log.Error(err.Error())
+		return ""
+	}
+	for _, account := range accounts {
+		if account.Locale != "" {
+			return account.Locale
+		}
+	}
+	return ""
+}
+
+func (r *RequestBundle) renderNotifications(notifications []Notification, user uint64) error {
+	locale, looked := "", false
+	for pos, notification := range notifications {
+		if notification.Body != "" {
+			continue
+		}
+		if !looked {
+			locale = r.getUserLocale(user)
+			looked = true
+		}
+		body, err := r.templates().Render(notification.Nature, locale, notification.Params)
+		if err != nil {
+			return err
+		}
+		notifications[pos].Body = body
+		notifications[pos].Templated = true
+	}
+	return nil
+}
+
+// localizeNotification renders a templated notification again in locale.
+// The body rendered when it was stored is kept if that fails.
+func (r *RequestBundle) localizeNotification(notification Notification, locale string) Notification {
+	if !notification.Templated {
+		return notification
+	}
+	body, err := r.templates().Render(notification.Nature, locale, notification.Params)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return notification
+	}
+	notification.Body = body
+	return notification
+}
+
+// LoadTemplates registers the templates in the directory named in the
+// configuration, unless a template registry has already been set. It should
+// be run on the base bundle when the process starts.
+func (r *RequestBundle) LoadTemplates() error {
+	if r.Templates != nil || r.Config.Templates == "" {
+		return nil
+	}
+	templates := NewTemplateRegistry(r.Config.DefaultLocale)
+	err := templates.LoadDir(r.Config.Templates)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return err
+	}
+	r.Templates = templates
+	return nil
+}
@@ -0,0 +1,156 @@
+package twocloud
+
+import (
+	"testing"
+)
+
+func testTemplates(t *testing.T) *TemplateRegistry {
+	templates := NewTemplateRegistry("en")
+	err := templates.Register(NotificationTemplate{
+		Nature: "device_paired",
+		Params: []string{"device"},
+		Locales: map[string]string{
+			"en":    "{device} was paired.",
+			"pt_BR": "{device} foi pareado.",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return templates
+}
+
+func TestRenderFallsBackToBaseAndDefaultLocale(t *testing.T) {
+	templates := testTemplates(t)
+	params := map[string]string{"device": "Phone"}
+	cases := map[string]string{
+		"pt-BR": "Phone foi pareado.",
+		"en-GB": "Phone was paired.",
+		"fr":    "Phone was paired.",
+		"":      "Phone was paired.",
+	}
+	for locale, expected := range cases {
+		body, err := templates.Render("device_paired", locale, params)
+		if err != nil {
+			t.Errorf("Rendering for %q: %s", locale, err)
+			continue
+		}
+		if body != expected {
+			t.Errorf("Rendering for %q gave %q, expected %q.", locale, body, expected)
+		}
+	}
+}
+
+func TestRenderMissingParam(t *testing.T) {
+	templates := testTemplates(t)
+	_, err := templates.Render("device_paired", "en", map[string]string{})
+	missing, ok := err.(*MissingTemplateParamError)
+	if !ok {
+		t.Fatalf("Expected a MissingTemplateParamError, got %v.", err)
+	}
+	if missing.Nature != "device_paired" || missing.Param != "device" {
+		t.Errorf("Error names nature %q and param %q.", missing.Nature, missing.Param)
+	}
+}
+
+func TestRenderMissingLocale(t *testing.T) {
+	templates := NewTemplateRegistry("en")
+	err := templates.Register(NotificationTemplate{
+		Nature:  "device_paired",
+		Locales: map[string]string{"de": "Gekoppelt."},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = templates.Render("device_paired", "fr-CA", nil)
+	missing, ok := err.(*MissingTemplateLocaleError)
+	if !ok {
+		t.Fatalf("Expected a MissingTemplateLocaleError, got %v.", err)
+	}
+	if missing.Nature != "device_paired" || missing.Locale != "fr-CA" {
+		t.Errorf("Error names nature %q and locale %q.", missing.Nature, missing.Locale)
+	}
+}
+
+func TestRenderUnknownNature(t *testing.T) {
+	templates := testTemplates(t)
+	_, err := templates.Render("link_flagged", "en", nil)
+	if err != TemplateNotFoundError {
+		t.Errorf("Expected TemplateNotFoundError, got %v.", err)
+	}
+}
+
+func TestLocalizeNotificationRendersInRecipientLocale(t *testing.T) {
+	r := &RequestBundle{Log: NullLogger(), Templates: testTemplates(t)}
+	notification := Notification{
+		Nature:    "device_paired",
+		Body:      "Phone was paired.",
+		Params:    map[string]string{"device": "Phone"},
+		Templated: true,
+	}
+	localized := r.localizeNotification(notification, "pt-br")
+	if localized.Body != "Phone foi pareado." {
+		t.Errorf("Localized body is %q.", localized.Body)
+	}
+	notification.Params = nil
+	localized = r.localizeNotification(notification, "pt-br")
+	if localized.Body != notification.Body {
+		t.Errorf("Expected the stored body when rendering fails, got %q.", localized.Body)
+	}
+}
+
+func TestPairingNotificationRendersInRequesterLocale(t *testing.T) {
+	r, _ := testBundle(t)
+	r.Templates = NewTemplateRegistry("en")
+	err := r.Templates.Register(NotificationTemplate{
+		Nature: "device_paired",
+		Params: []string{"device"},
+		Locales: map[string]string{
+			"en":    "\"{device}\" was added to your account.",
+			"pt-BR": "\"{device}\" foi adicionado à sua conta.",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testUser(t, r, "10", "pt_BR")
+	testDevice(t, r, "1", "10")
+	requester, err := r.GetDevice(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := r.RequestPairingCode(requester)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, err = r.RedeemPairingCode(code.Code, "Tablet", "android_tablet", "203.0.113.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifications, err := r.GetNotificationsByDevice(requester, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notifications) != 1 {
+		t.Fatalf("Expected one notification, got %d.", len(notifications))
+	}
+	if notifications[0].Body != "\"Tablet\" foi adicionado à sua conta." {
+		t.Errorf("Notification body is %q.", notifications[0].Body)
+	}
+}
+
+func TestBuiltinTemplatesRenderWithoutARegistry(t *testing.T) {
+	r, _ := testBundle(t)
+	testUser(t, r, "10", "de")
+	notifications := []Notification{{
+		Nature: "link_reply",
+		Params: map[string]string{"reply": "Thanks!"},
+	}}
+	err := r.renderNotifications(notifications, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notifications[0].Body != "New reply to your link: Thanks!" {
+		t.Errorf("Notification body is %q.", notifications[0].Body)
+	}
+}
@@ -0,0 +1,274 @@
+package twocloud
+
+import (
+	"errors"
+	"github.com/fzzbt/radix/redis"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type LinkReply struct {
+	ID     uint64    `json:"id,omitempty"`
+	LinkID uint64    `json:"link_id,omitempty"`
+	Author Device    `json:"author,omitempty"`
+	Body   string    `json:"body,omitempty"`
+	Sent   time.Time `json:"sent,omitempty"`
+}
+
+var EmptyReplyError = errors.New("A reply must have a body.")
+var NotParticipantError = errors.New("Only the devices a link was shared between can reply to it.")
+
+func pageIDs(ids []string, before, after uint64, count int) []string {
+	page := []string{}
+	for _, idstr := range ids {
+		id, err := strconv.ParseUint(idstr, 10, 64)
+		if err != nil {
+			continue
+		}
+		if before != 0 && id >= before {
+			continue
+		}
+		if after != 0 && id <= after {
+			continue
+		}
+		page = append(page, idstr)
+		if count > 0 && len(page) >= count {
+			break
+		}
+	}
+	return page
+}
+
+func (r *RequestBundle) AddReply(link Link, author Device, body string) (LinkReply, error) {
+	// start instrumentation
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return LinkReply{}, EmptyReplyError
+	}
+	if author.ID != link.Sender.ID && author.ID != link.Receiver.ID {
+		return LinkReply{}, NotParticipantError
+	}
+	id, err := r.GetID()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return LinkReply{}, err
+	}
+	reply := LinkReply{
+		ID:     id,
+		LinkID: link.ID,
+		Author: author,
+		Body:   body,
+		Sent:   time.Now(),
+	}
+	participants, err := r.getThreadParticipants(link)
+	if err != nil {
+		return LinkReply{}, err
+	}
+	participants[author.ID] = true
+	changes := map[string]interface{}{
+		"link_id": link.ID,
+		"author":  author.ID,
+		"body":    reply.Body,
+		"sent":    reply.Sent.Format(time.RFC3339),
+	}
+	from := map[string]interface{}{
+		"link_id": "",
+		"author":  "",
+		"body":    "",
+		"sent":    "",
+	}
+	linkKey := "links:" + strconv.FormatUint(link.ID, 10)
+	rep := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		mc.Hmset("replies:"+strconv.FormatUint(id, 10), changes)
+		mc.Lpush(linkKey+":replies", id)
+		for device, _ := range participants {
+			mc.Sadd(linkKey+":participants", device)
+			if device == author.ID {
+				continue
+			}
+			mc.Hincrby("devices:"+strconv.FormatUint(device, 10)+":replies:unread", link.ID, 1)
+		}
+	})
+	// add repo call to instrumentation
+	if rep.Err != nil {
+		r.Log.Error(rep.Err.Error())
+		return LinkReply{}, rep.Err
+	}
+	r.AuditMap("replies:"+strconv.FormatUint(id, 10), from, changes)
+	// add repo call to instrumentation
+	for device, _ := range participants {
+		if device == author.ID {
+			continue
+		}
+		notification := Notification{
+			Nature:          "link_reply",
+			Params:          map[string]string{"reply": reply.Body},
+			Destination:     device,
+			DestinationType: "device",
+		}
+		receiver, err := r.GetDevice(device)
+		if err != nil {
+			r.Log.Error(err.Error())
+			continue
+		}
+		_, err = r.SendNotificationsToDevice(receiver, []Notification{notification})
+		if err != nil {
+			r.Log.Error(err.Error())
+		}
+	}
+	// stop instrumentation
+	return reply, nil
+}
+
+func (r *RequestBundle) getThreadParticipants(link Link) (map[uint64]bool, error) {
+	participants := map[uint64]bool{}
+	if link.Sender.ID != 0 {
+		participants[link.Sender.ID] = true
+	}
+	if link.Receiver.ID != 0 {
+		participants[link.Receiver.ID] = true
+	}
+	reply := r.Repo.client.Smembers("links:" + strconv.FormatUint(link.ID, 10) + ":participants")
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return participants, reply.Err
+	}
+	if reply.Type == redis.ReplyNil {
+		return participants, nil
+	}
+	ids, err := reply.List()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return participants, err
+	}
+	for _, idstr := range ids {
+		id, err := strconv.ParseUint(idstr, 10, 64)
+		if err != nil {
+			r.Log.Error(err.Error())
+			continue
+		}
+		participants[id] = true
+	}
+	return participants, nil
+}
+
+func (r *RequestBundle) GetReplies(link Link, before, after uint64, count int) ([]LinkReply, error) {
+	// start instrumentation
+	reply := r.Repo.client.Lrange("links:"+strconv.FormatUint(link.ID, 10)+":replies", 0, -1)
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return []LinkReply{}, reply.Err
+	}
+	if reply.Type == redis.ReplyNil {
+		return []LinkReply{}, nil
+	}
+	ids, err := reply.List()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return []LinkReply{}, err
+	}
+	ids = pageIDs(ids, before, after, count)
+	reply = r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		for _, id := range ids {
+			mc.Hgetall("replies:" + id)
+		}
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return []LinkReply{}, reply.Err
+	}
+	replies := []LinkReply{}
+	authors := map[uint64]Device{}
+	for pos, elem := range reply.Elems {
+		if elem.Type == redis.ReplyNil {
+			continue
+		}
+		hash, err := elem.Hash()
+		if err != nil {
+			r.Log.Error(err.Error())
+			continue
+		}
+		id, err := strconv.ParseUint(ids[pos], 10, 64)
+		if err != nil {
+			r.Log.Error(err.Error())
+			continue
+		}
+		sent, err := time.Parse(time.RFC3339, hash["sent"])
+		if err != nil {
+			r.Log.Error(err.Error())
+			continue
+		}
+		author_id, err := strconv.ParseUint(hash["author"], 10, 64)
+		if err != nil {
+			r.Log.Error(err.Error())
+			continue
+		}
+		author, cached := authors[author_id]
+		if !cached {
+			author, err = r.GetDevice(author_id)
+			if err != nil {
+				author = Device{ID: author_id}
+			}
+			authors[author_id] = author
+		}
+		replies = append(replies, LinkReply{
+			ID:     id,
+			LinkID: link.ID,
+			Author: author,
+			Body:   hash["body"],
+			Sent:   sent,
+		})
+	}
+	// stop instrumentation
+	return replies, nil
+}
+
+func (r *RequestBundle) GetUnreadReplyCounts(device Device) (map[uint64]int64, error) {
+	// start instrumentation
+	reply := r.Repo.client.Hgetall("devices:" + strconv.FormatUint(device.ID, 10) + ":replies:unread")
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return map[uint64]int64{}, reply.Err
+	}
+	counts := map[uint64]int64{}
+	if reply.Type == redis.ReplyNil {
+		return counts, nil
+	}
+	hash, err := reply.Hash()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return counts, err
+	}
+	for linkstr, countstr := range hash {
+		link_id, err := strconv.ParseUint(linkstr, 10, 64)
+		if err != nil {
+			r.Log.Error(err.Error())
+			continue
+		}
+		count, err := strconv.ParseInt(countstr, 10, 64)
+		if err != nil {
+			r.Log.Error(err.Error())
+			continue
+		}
+		counts[link_id] = count
+	}
+	// stop instrumentation
+	return counts, nil
+}
+
+func (r *RequestBundle) MarkRepliesRead(link Link, device Device) error {
+	// start instrumentation
+	reply := r.Repo.client.Hdel("devices:"+strconv.FormatUint(device.ID, 10)+":replies:unread", link.ID)
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return reply.Err
+	}
+	// stop instrumentation
+	return nil
+}
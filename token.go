@@ -0,0 +1,269 @@
+package twocloud
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/fzzbt/radix/redis"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DeviceToken describes a device's credentials without the token itself,
+// which is only ever known to the device it was issued to.
+type DeviceToken struct {
+	Device   uint64    `json:"device,omitempty"`
+	Name     string    `json:"name,omitempty"`
+	Issued   time.Time `json:"issued,omitempty"`
+	LastUsed time.Time `json:"last_used,omitempty"`
+	LastIP   string    `json:"last_ip,omitempty"`
+}
+
+var InvalidDeviceTokenError = errors.New("The device token was not valid.")
+var DeviceTokenNotFoundError = errors.New("The device doesn't have a token.")
+
+func hashDeviceToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueDeviceToken gives a device a new token, replacing any it already
+// had. Only a hash of the token is stored, in the device's hash and in
+// device_tokens, which maps it back to the device; the token itself is
+// returned and can't be recovered afterwards.
+func (r *RequestBundle) IssueDeviceToken(device Device) (string, error) {
+	// start instrumentation
+	token, err := GenerateSecret()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return "", err
+	}
+	key := "devices:" + strconv.FormatUint(device.ID, 10)
+	reply := r.Repo.client.Hget(key, "token_hash")
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return "", reply.Err
+	}
+	old := ""
+	if reply.Type != redis.ReplyNil {
+		old, err = reply.Str()
+		if err != nil {
+			r.Log.Error(err.Error())
+			return "", err
+		}
+	}
+	hash := hashDeviceToken(token)
+	issued := time.Now().Format(time.RFC3339)
+	reply = r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		if old != "" {
+			mc.Hdel("device_tokens", old)
+		}
+		mc.Hset("device_tokens", hash, device.ID)
+		mc.Hmset(key, map[string]interface{}{
+			"token_hash":      hash,
+			"token_issued":    issued,
+			"token_last_used": "",
+		})
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return "", reply.Err
+	}
+	r.AuditMap(key, map[string]interface{}{
+		"token_hash":   old,
+		"token_issued": "",
+	}, map[string]interface{}{
+		"token_hash":   hash,
+		"token_issued": issued,
+	})
+	// add repo call to instrumentation
+	// stop instrumentation
+	return token, nil
+}
+
+// AuthenticateDevice resolves the device and user a token was issued to,
+// and makes them the bundle's Device and AuthUser.
+func (r *RequestBundle) AuthenticateDevice(token string) (User, Device, error) {
+	// start instrumentation
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return User{}, Device{}, InvalidDeviceTokenError
+	}
+	reply := r.Repo.client.Hget("device_tokens", hashDeviceToken(token))
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return User{}, Device{}, reply.Err
+	}
+	if reply.Type == redis.ReplyNil {
+		r.Log.Warn("Invalid device token used.")
+		// report invalid auth attempt to stats
+		return User{}, Device{}, InvalidDeviceTokenError
+	}
+	idstr, err := reply.Str()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return User{}, Device{}, err
+	}
+	id, err := strconv.ParseUint(idstr, 10, 64)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return User{}, Device{}, err
+	}
+	device, err := r.GetDevice(id)
+	if err == DeviceNotFoundError {
+		return User{}, Device{}, InvalidDeviceTokenError
+	} else if err != nil {
+		return User{}, Device{}, err
+	}
+	user, err := r.GetUser(device.UserID)
+	if err != nil {
+		return User{}, Device{}, err
+	}
+	reply = r.Repo.client.Hset("devices:"+strconv.FormatUint(device.ID, 10), "token_last_used", time.Now().Format(time.RFC3339))
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+	}
+	ip := r.remoteAddr()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if ip != "" {
+		seen, err := r.UpdateDeviceLastSeen(device, ip)
+		if err != nil {
+			r.Log.Error(err.Error())
+		} else {
+			device = seen
+		}
+	}
+	err = r.updateUserLastActive(user.ID)
+	if err != nil {
+		r.Log.Error(err.Error())
+	}
+	// report user activity to stats
+	r.AuthUser = user
+	r.Device = device
+	// stop instrumentation
+	return user, device, r.subscriptionError(user)
+}
+
+// RevokeDeviceToken signs a single device out without touching the user's
+// other devices.
+func (r *RequestBundle) RevokeDeviceToken(device Device) error {
+	// start instrumentation
+	key := "devices:" + strconv.FormatUint(device.ID, 10)
+	reply := r.Repo.client.Hmget(key, "token_hash", "token_issued")
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return reply.Err
+	}
+	fields, err := reply.List()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return err
+	}
+	if len(fields) < 2 || fields[0] == "" {
+		return DeviceTokenNotFoundError
+	}
+	reply = r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		mc.Hdel("device_tokens", fields[0])
+		mc.Hdel(key, "token_hash", "token_issued", "token_last_used")
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return reply.Err
+	}
+	r.AuditMap(key, map[string]interface{}{
+		"token_hash":   fields[0],
+		"token_issued": fields[1],
+	}, map[string]interface{}{
+		"token_hash":   "",
+		"token_issued": "",
+	})
+	// add repo call to instrumentation
+	// stop instrumentation
+	return nil
+}
+
+// GetDeviceTokens lists the devices of a user that hold a token, with when
+// each token was last used and the IP the device was last seen from.
+func (r *RequestBundle) GetDeviceTokens(user User) ([]DeviceToken, error) {
+	// start instrumentation
+	devices, err := r.GetDevicesByUser(user)
+	if err != nil {
+		return []DeviceToken{}, err
+	}
+	if len(devices) < 1 {
+		return []DeviceToken{}, nil
+	}
+	reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		for _, device := range devices {
+			mc.Hmget("devices:"+strconv.FormatUint(device.ID, 10), "token_hash", "token_issued", "token_last_used")
+		}
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return []DeviceToken{}, reply.Err
+	}
+	tokens := []DeviceToken{}
+	for pos, elem := range reply.Elems {
+		fields, err := elem.List()
+		if err != nil {
+			r.Log.Error(err.Error())
+			return []DeviceToken{}, err
+		}
+		if len(fields) < 3 || fields[0] == "" {
+			continue
+		}
+		token := DeviceToken{
+			Device: devices[pos].ID,
+			Name:   devices[pos].Name,
+			LastIP: devices[pos].LastIP,
+		}
+		if fields[1] != "" {
+			token.Issued, err = time.Parse(time.RFC3339, fields[1])
+			if err != nil {
+				r.Log.Error(err.Error())
+				return []DeviceToken{}, err
+			}
+		}
+		if fields[2] != "" {
+			token.LastUsed, err = time.Parse(time.RFC3339, fields[2])
+			if err != nil {
+				r.Log.Error(err.Error())
+				return []DeviceToken{}, err
+			}
+		}
+		tokens = append(tokens, token)
+	}
+	// stop instrumentation
+	return tokens, nil
+}
+
+// DeviceTokenAuthenticator authenticates push connections by device token,
+// sent either as "Authorization: Device <token>" or, for clients that can't
+// set headers, in the token query parameter.
+func DeviceTokenAuthenticator(base RequestBundle) DeviceAuthenticator {
+	return func(req *http.Request) (User, Device, error) {
+		token := req.URL.Query().Get("token")
+		if header := req.Header.Get("Authorization"); strings.HasPrefix(header, "Device ") {
+			token = strings.TrimPrefix(header, "Device ")
+		}
+		bundle := base
+		bundle.Request = req
+		user, device, err := bundle.AuthenticateDevice(token)
+		if _, warning := err.(*SubscriptionExpiredWarning); warning {
+			err = nil
+		}
+		return user, device, err
+	}
+}
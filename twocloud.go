@@ -11,7 +11,15 @@ type RequestBundle struct {
 	Config    Config
 	Log       *Log
 	// Cache
-	Auditor *Auditor
+	Auditor        *Auditor
+	Blobs          BlobStore
+	Screener       URLScreener
+	Templates      *TemplateRegistry
+	ClientTypes    *ClientTypeRegistry
+	Mailer         MailTransport
+	GCM            *GCMClient
+	PushTransports *PusherRegistry
+	Pushes         *PushQueue
 	// Instrumentor
 	// Instrument
 	Request  *http.Request
@@ -19,6 +27,35 @@ type RequestBundle struct {
 	Device   Device
 }
 
+// NewRequestBundle sets up the base bundle that each request's bundle is
+// copied from. The copies share its registries, so client types, templates
+// and the URL blocklist are loaded once per process rather than per request.
+func NewRequestBundle(config Config, log *Log) (*RequestBundle, error) {
+	generator, err := noeq.New(config.Generator.Token, config.Generator.Address)
+	if err != nil {
+		return nil, err
+	}
+	r := &RequestBundle{
+		Generator:   generator,
+		Repo:        NewRadix(config.Database),
+		Config:      config,
+		Log:         log,
+		ClientTypes: NewClientTypeRegistry(builtinClientTypes...),
+	}
+	// failures are logged, and the stored client types are tried again at
+	// the next refresh in case Redis isn't up yet
+	r.LoadClientTypes()
+	err = r.LoadTemplates()
+	if err != nil {
+		return nil, err
+	}
+	err = r.LoadScreener()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
 func (rb *RequestBundle) GetID() (id uint64, err error) {
 	for trys := 5; trys > 0; trys-- {
 		id, err = rb.Generator.GenOne()
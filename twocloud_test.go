@@ -0,0 +1,163 @@
+package twocloud
+
+import (
+	"encoding/binary"
+	"github.com/alicebob/miniredis/v2"
+	miniserver "github.com/alicebob/miniredis/v2/server"
+	"github.com/fzzbt/radix/redis"
+	"github.com/noeq/noeq"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// testBundle gives a test its own in-memory Redis, which runs the Lua
+// scripts like the real thing and can be made to fail on demand, and an
+// ID generator, so tests don't need any outside services.
+func testBundle(t *testing.T) (*RequestBundle, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	repo := NewRadix(redis.Config{Address: server.Addr()})
+	t.Cleanup(repo.Close)
+	generator, err := noeq.New("", testGenerator(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &RequestBundle{
+		Repo:      repo,
+		Generator: generator,
+		Log:       NullLogger(),
+		Config:    Config{DuplicateWindow: 60},
+	}, server
+}
+
+// testGenerator serves IDs counting up from 1000 the way noeqd hands them
+// out, and returns the address to reach it on.
+func testGenerator(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	next := uint64(999)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				request := make([]byte, 1)
+				for {
+					_, err := io.ReadFull(conn, request)
+					if err != nil {
+						return
+					}
+					// a zero byte starts a token, which is taken as read
+					if request[0] == 0 {
+						_, err = io.ReadFull(conn, request)
+						if err == nil {
+							_, err = io.CopyN(io.Discard, conn, int64(request[0]))
+						}
+						if err != nil {
+							return
+						}
+						continue
+					}
+					for i := 0; i < int(request[0]); i++ {
+						err = binary.Write(conn, binary.BigEndian, atomic.AddUint64(&next, 1))
+						if err != nil {
+							return
+						}
+					}
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func testDevice(t *testing.T, r *RequestBundle, id, userID string) {
+	reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		mc.Hmset("devices:"+id, map[string]interface{}{
+			"user_id":     userID,
+			"client_type": "android_phone",
+			"last_seen":   "2013-01-01T00:00:00Z",
+			"created":     "2013-01-01T00:00:00Z",
+		})
+		mc.Zadd("users:"+userID+":devices", id, id)
+	})
+	if reply.Err != nil {
+		t.Fatal(reply.Err)
+	}
+	for _, elem := range reply.Elems {
+		if elem.Err != nil {
+			t.Fatal(elem.Err)
+		}
+	}
+}
+
+// testUser stores a user with a single account in locale.
+func testUser(t *testing.T, r *RequestBundle, id, locale string) {
+	reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		mc.Hmset("users:"+id, map[string]interface{}{
+			"username":             "user" + id,
+			"joined":               "2013-01-01T00:00:00Z",
+			"last_active":          "2013-01-01T00:00:00Z",
+			"subscription_expires": "2099-01-01T00:00:00Z",
+		})
+		mc.Hset("usernames_to_ids", "user"+id, id)
+		mc.Hmset("accounts:"+id, map[string]interface{}{
+			"user_id": id,
+			"locale":  locale,
+			"added":   "2013-01-01T00:00:00Z",
+			"expires": "2013-01-01T00:00:00Z",
+		})
+		mc.Sadd("users:"+id+":accounts", id)
+	})
+	if reply.Err != nil {
+		t.Fatal(reply.Err)
+	}
+	for _, elem := range reply.Elems {
+		if elem.Err != nil {
+			t.Fatal(elem.Err)
+		}
+	}
+}
+
+// failCommandOnce makes the next cmd on key fail, leaving every other
+// command alone.
+func failCommandOnce(server *miniredis.Miniredis, cmd, key string) {
+	var failed int32
+	server.Server().SetPreHook(func(peer *miniserver.Peer, name string, args ...string) bool {
+		if name != cmd || len(args) < 1 || args[0] != key {
+			return false
+		}
+		if !atomic.CompareAndSwapInt32(&failed, 0, 1) {
+			return false
+		}
+		peer.WriteError("ERR injected failure")
+		return true
+	})
+}
+
+// assertNoKeys fails the test for each key that exists.
+func assertNoKeys(t *testing.T, server *miniredis.Miniredis, keys ...string) {
+	for _, key := range keys {
+		if server.Exists(key) {
+			t.Errorf("%s was left behind.", key)
+		}
+	}
+}
+
+// assertKeyCount fails the test unless the database holds exactly count
+// keys, so writes outside the ones a test knows about are caught too.
+func assertKeyCount(t *testing.T, server *miniredis.Miniredis, count int) {
+	keys := server.Keys()
+	if len(keys) != count {
+		t.Errorf("Expected %d keys, found %d: %v", count, len(keys), keys)
+	}
+}
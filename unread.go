@@ -0,0 +1,152 @@
+package twocloud
+
+import (
+	"github.com/fzzbt/radix/redis"
+	"strconv"
+)
+
+type UnreadCount struct {
+	DeviceID      uint64 `json:"device_id,omitempty"`
+	Links         int64  `json:"links"`
+	Notifications int64  `json:"notifications"`
+}
+
+type UnreadCounts struct {
+	User    UnreadCount   `json:"user"`
+	Devices []UnreadCount `json:"devices"`
+}
+
+func unreadCountFromHash(hash map[string]string) UnreadCount {
+	count := UnreadCount{}
+	count.Links, _ = strconv.ParseInt(hash["links"], 10, 64)
+	count.Notifications, _ = strconv.ParseInt(hash["notifications"], 10, 64)
+	return count
+}
+
+func (r *RequestBundle) getUserDeviceIDs(user User) ([]string, error) {
+	reply := r.Repo.client.Zrevrange("users:"+strconv.FormatUint(user.ID, 10)+":devices", 0, -1)
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return []string{}, reply.Err
+	}
+	if reply.Type == redis.ReplyNil {
+		return []string{}, nil
+	}
+	ids, err := reply.List()
+	if err != nil {
+		r.Log.Error(err.Error())
+		return []string{}, err
+	}
+	return ids, nil
+}
+
+func (r *RequestBundle) GetUnreadCounts(user User) (UnreadCounts, error) {
+	// start instrumentation
+	ids, err := r.getUserDeviceIDs(user)
+	if err != nil {
+		return UnreadCounts{}, err
+	}
+	reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		mc.Hgetall("users:" + strconv.FormatUint(user.ID, 10) + ":unread_counts")
+		for _, id := range ids {
+			mc.Hgetall("devices:" + id + ":unread_counts")
+		}
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return UnreadCounts{}, reply.Err
+	}
+	counts := UnreadCounts{
+		Devices: []UnreadCount{},
+	}
+	for pos, elem := range reply.Elems {
+		hash := map[string]string{}
+		if elem.Type != redis.ReplyNil {
+			hash, err = elem.Hash()
+			if err != nil {
+				r.Log.Error(err.Error())
+				return UnreadCounts{}, err
+			}
+		}
+		count := unreadCountFromHash(hash)
+		if pos == 0 {
+			counts.User = count
+			continue
+		}
+		count.DeviceID, err = strconv.ParseUint(ids[pos-1], 10, 64)
+		if err != nil {
+			r.Log.Error(err.Error())
+			continue
+		}
+		counts.Devices = append(counts.Devices, count)
+	}
+	// stop instrumentation
+	return counts, nil
+}
+
+func (r *RequestBundle) ReconcileUnreadCounts(user User) (UnreadCounts, error) {
+	// start instrumentation
+	ids, err := r.getUserDeviceIDs(user)
+	if err != nil {
+		return UnreadCounts{}, err
+	}
+	scopes := []string{"users:" + strconv.FormatUint(user.ID, 10)}
+	for _, id := range ids {
+		scopes = append(scopes, "devices:"+id)
+	}
+	reply := r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		for _, scope := range scopes {
+			mc.Llen(scope + ":links:unread")
+			mc.Llen(scope + ":notifications:unread")
+		}
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return UnreadCounts{}, reply.Err
+	}
+	if len(reply.Elems) != len(scopes)*2 {
+		return UnreadCounts{}, UnexpectedReplyError
+	}
+	counts := UnreadCounts{
+		Devices: []UnreadCount{},
+	}
+	for pos, _ := range scopes {
+		count := UnreadCount{}
+		count.Links, err = reply.Elems[pos*2].Int64()
+		if err != nil {
+			r.Log.Error(err.Error())
+			return UnreadCounts{}, err
+		}
+		count.Notifications, err = reply.Elems[pos*2+1].Int64()
+		if err != nil {
+			r.Log.Error(err.Error())
+			return UnreadCounts{}, err
+		}
+		if pos == 0 {
+			counts.User = count
+			continue
+		}
+		count.DeviceID, err = strconv.ParseUint(ids[pos-1], 10, 64)
+		if err != nil {
+			r.Log.Error(err.Error())
+			return UnreadCounts{}, err
+		}
+		counts.Devices = append(counts.Devices, count)
+	}
+	reply = r.Repo.client.MultiCall(func(mc *redis.MultiCall) {
+		mc.Hmset(scopes[0]+":unread_counts", "links", counts.User.Links, "notifications", counts.User.Notifications)
+		for pos, count := range counts.Devices {
+			mc.Hmset(scopes[pos+1]+":unread_counts", "links", count.Links, "notifications", count.Notifications)
+		}
+	})
+	// add repo call to instrumentation
+	if reply.Err != nil {
+		r.Log.Error(reply.Err.Error())
+		return UnreadCounts{}, reply.Err
+	}
+	// stop instrumentation
+	return counts, nil
+}
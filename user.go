@@ -27,6 +27,7 @@ type User struct {
 	Joined            time.Time     `json:"joined,omitempty"`
 	Name              Name          `json:"name,omitempty"`
 	LastActive        time.Time     `json:"last_active,omitempty"`
+	LastDigest        time.Time     `json:"last_digest,omitempty"`
 	IsAdmin           bool          `json:"is_admin,omitempty"`
 	Subscription      *Subscription `json:"subscription,omitempty"`
 }
@@ -154,19 +155,22 @@ func (r *RequestBundle) Authenticate(username, secret string) (User, error) {
 	// add repo call to instrumentation
 	// report user activity to stats
 	// add repo calls to instrumentation
-	var subscriptionError error
-	if r.Config.UseSubscriptions {
-		r.UpdateSubscriptionStatus(user)
-		if !user.Subscription.Active && !user.IsAdmin {
-			if !user.Subscription.InGracePeriod {
-				subscriptionError = &SubscriptionExpiredError{Expired: user.Subscription.Expires}
-			} else {
-				subscriptionError = &SubscriptionExpiredWarning{Expired: user.Subscription.Expires}
-			}
-		}
-	}
 	// store instrumentation
-	return user, subscriptionError
+	return user, r.subscriptionError(user)
+}
+
+func (r *RequestBundle) subscriptionError(user User) error {
+	if !r.Config.UseSubscriptions {
+		return nil
+	}
+	r.UpdateSubscriptionStatus(user)
+	if user.Subscription.Active || user.IsAdmin {
+		return nil
+	}
+	if !user.Subscription.InGracePeriod {
+		return &SubscriptionExpiredError{Expired: user.Subscription.Expires}
+	}
+	return &SubscriptionExpiredWarning{Expired: user.Subscription.Expires}
 }
 
 func (r *RequestBundle) updateUserLastActive(id uint64) error {
@@ -441,6 +445,13 @@ func (r *RequestBundle) GetUser(id uint64) (User, error) {
 			ID:      hash["subscription_id"],
 		},
 	}
+	if hash["last_digest"] != "" {
+		user.LastDigest, err = time.Parse(time.RFC3339, hash["last_digest"])
+		if err != nil {
+			r.Log.Error(err.Error())
+			return User{}, err
+		}
+	}
 	r.UpdateSubscriptionStatus(user)
 	// stop instrumentation
 	return user, nil